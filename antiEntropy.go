@@ -0,0 +1,411 @@
+package vitarit
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	merkleLeaves          = 256             // Buckets keys are spread into, leaves of the tree
+	defaultSyncInterval   = 5 * time.Minute // Time between two anti-entropy rounds
+	defaultSyncKeysPerSec = 200             // Keys streamed per second while repairing replicas
+)
+
+// merkleEntry is the digest of one key exchanged between replicas
+type merkleEntry struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+	Crc     uint32 `json:"crc"`
+	Deleted bool   `json:"deleted,omitempty"` // Key was removed, version is the one of the remove
+}
+
+// merkleTree is a complete binary tree in heap layout, node i has children 2i+1 and 2i+2
+// Leaves hash the digests of the keys falling in their bucket
+type merkleTree []uint64
+
+// -----------------------------------------------------------------------
+
+// merkleBucket returns the leaf a key is hashed into
+func merkleBucket(key string) int {
+	return int(FNV1a64Hasher.Sum64([]byte(key)) % merkleLeaves)
+}
+
+// buildMerkleTree builds the tree over the given digests
+func buildMerkleTree(entries []merkleEntry) merkleTree {
+	buckets := make([][]merkleEntry, merkleLeaves)
+	for _, entry := range entries {
+		b := merkleBucket(entry.Key)
+		buckets[b] = append(buckets[b], entry)
+	}
+
+	tree := make(merkleTree, 2*merkleLeaves-1)
+	for b, bucket := range buckets {
+		sort.Slice(bucket, func(i, j int) bool {
+			return bucket[i].Key < bucket[j].Key
+		})
+
+		var leaf strings.Builder
+		for _, entry := range bucket {
+			fmt.Fprintf(&leaf, "%s\x00%d\x00%d\x00%v\n", entry.Key, entry.Version, entry.Crc, entry.Deleted)
+		}
+
+		if leaf.Len() > 0 {
+			tree[merkleLeaves-1+b] = FNV1a64Hasher.Sum64([]byte(leaf.String()))
+		}
+	}
+
+	buf := make([]byte, 16)
+	for i := merkleLeaves - 2; i >= 0; i-- {
+		binary.LittleEndian.PutUint64(buf[:8], tree[2*i+1])
+		binary.LittleEndian.PutUint64(buf[8:], tree[2*i+2])
+		tree[i] = FNV1a64Hasher.Sum64(buf)
+	}
+
+	return tree
+}
+
+// diff returns the buckets whose leaves differ, subtrees with equal hashes are not descended into
+func (tree merkleTree) diff(other merkleTree) []int {
+	buckets := []int{}
+	if len(other) != len(tree) {
+		for b := 0; b < merkleLeaves; b++ {
+			buckets = append(buckets, b)
+		}
+		return buckets
+	}
+
+	var walk func(i int)
+	walk = func(i int) {
+		if tree[i] == other[i] {
+			return
+		}
+
+		if i >= merkleLeaves-1 {
+			buckets = append(buckets, i-(merkleLeaves-1))
+			return
+		}
+
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+
+	return buckets
+}
+
+// -----------------------------------------------------------------------
+
+// sharedEntries returns digests of the local keys that the peer also holds a copy of
+// When buckets is not nil only keys falling in those buckets are returned
+func (cache *distributedCache) sharedEntries(peerID string, buckets map[int]bool) []merkleEntry {
+	entries := []merkleEntry{}
+	for _, entry := range cache.local.digests() {
+		if buckets != nil && !buckets[merkleBucket(entry.Key)] {
+			continue
+		}
+
+		peerOwns, localOwns := false, false
+		for _, cnode := range cache.hashRing.getNodes(entry.Key, cache.redundancy) {
+			peerOwns = peerOwns || cnode.ID == peerID
+			localOwns = localOwns || cnode.ID == cache.local.ID
+		}
+
+		if peerOwns && localOwns {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// copyOf returns which copy of the key a node should hold, -1 when it is not an owner
+func (cache *distributedCache) copyOf(key string, nodeID string) int {
+	for idx, cnode := range cache.hashRing.getNodes(key, cache.redundancy) {
+		if cnode.ID == nodeID {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// createURLForMerkle creates a URL to fetch the tree, or the digests of some buckets, a node shares with this one
+func createURLForMerkle(cnode *cacheNode, peerID string, buckets []int) string {
+	url := fmt.Sprintf("https://%s:%s/merkle?id=%s&peer=%s", cnode.IP, cnode.Port, cnode.ID, peerID)
+	if buckets != nil {
+		list := make([]string, 0, len(buckets))
+		for _, b := range buckets {
+			list = append(list, strconv.Itoa(b))
+		}
+		url += "&buckets=" + strings.Join(list, ",")
+	}
+
+	return url
+}
+
+// fetchMerkle asks a peer for its tree or bucket digests and decodes the JSON answer into out
+func (cache *distributedCache) fetchMerkle(cnode *cacheNode, buckets []int, out interface{}) error {
+	ctx, cancel := cache.backgroundContext()
+	defer cancel()
+
+	resp, err := cache.send(ctx, cnode, http.MethodGet, 0, nil, func(target *cacheNode) string {
+		return createURLForMerkle(target, cache.local.ID, buckets)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("merkle request to %s failed: %s", cnode.ID, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// serveMerkle answers a peer with the tree over the keys both hold, or with the digests of the requested buckets
+func (cnode *cacheNode) serveMerkle(w http.ResponseWriter, r *http.Request) {
+	if cnode.cache == nil || r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	peerID := r.URL.Query().Get("peer")
+	list := r.URL.Query().Get("buckets")
+
+	var reply interface{}
+	if list == "" {
+		logMessage(LOG_DEBUG, cnode.ID+" building merkle tree for "+peerID)
+		reply = buildMerkleTree(cnode.cache.sharedEntries(peerID, nil))
+	} else {
+		buckets := make(map[int]bool)
+		for _, b := range strings.Split(list, ",") {
+			idx, err := strconv.Atoi(b)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			buckets[idx] = true
+		}
+		reply = cnode.cache.sharedEntries(peerID, buckets)
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// -----------------------------------------------------------------------
+
+// runAntiEntropy periodically synchronises replicas until the cache stops
+func (cache *distributedCache) runAntiEntropy() {
+	if cache.config.syncInterval <= 0 {
+		return
+	}
+
+	logMessage(LOG_DEBUG, "start anti-entropy every "+cache.config.syncInterval.String())
+
+	ticker := time.NewTicker(cache.config.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cache.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cache.antiEntropy(); err != nil {
+				logMessage(LOG_ERROR, "anti-entropy failed: "+err.Error())
+			}
+		}
+	}
+}
+
+// antiEntropy compares the keys shared with every peer and streams the ones that differ
+func (cache *distributedCache) antiEntropy() error {
+	if !cache.syncing.TryLock() {
+		return fmt.Errorf("anti-entropy already running")
+	}
+	defer cache.syncing.Unlock()
+
+	if err := cache.ctx.Err(); err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, peer := range cache.getPeers() {
+		if peer.ID == cache.local.ID {
+			continue
+		}
+
+		if err := cache.syncWith(peer.ID); err != nil {
+			logMessage(LOG_ERROR, "anti-entropy with "+peer.ID+" failed: "+err.Error())
+			failed = append(failed, peer.ID)
+		}
+	}
+
+	cache.stats.syncRounds.Add(1)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("anti-entropy failed with %s", strings.Join(failed, ","))
+	}
+
+	return nil
+}
+
+// syncWith exchanges trees with one peer and repairs the differing keys in both directions
+func (cache *distributedCache) syncWith(peerID string) error {
+	peer := cache.getNodeByID(peerID)
+	if peer == nil {
+		return fmt.Errorf("unknown node %s", peerID)
+	}
+
+	var remote merkleTree
+	if err := cache.fetchMerkle(peer, nil, &remote); err != nil {
+		return err
+	}
+
+	buckets := buildMerkleTree(cache.sharedEntries(peerID, nil)).diff(remote)
+	if len(buckets) == 0 {
+		logMessage(LOG_DEBUG, "anti-entropy: in sync with "+peerID)
+		return nil
+	}
+
+	logMessage(LOG_DEBUG, "anti-entropy: "+strconv.Itoa(len(buckets))+" buckets differ with "+peerID)
+
+	var theirs []merkleEntry
+	if err := cache.fetchMerkle(peer, buckets, &theirs); err != nil {
+		return err
+	}
+
+	wanted := make(map[int]bool)
+	for _, b := range buckets {
+		wanted[b] = true
+	}
+
+	remoteEntries := make(map[string]merkleEntry)
+	for _, entry := range theirs {
+		remoteEntries[entry.Key] = entry
+	}
+
+	localEntries := make(map[string]merkleEntry)
+	for _, entry := range cache.sharedEntries(peerID, wanted) {
+		localEntries[entry.Key] = entry
+	}
+
+	// Keys streamed per second are limited so a large divergence does not flood the network
+	limiter := time.NewTicker(time.Second / time.Duration(max(cache.config.syncRate, 1)))
+	defer limiter.Stop()
+
+	for key, mine := range localEntries {
+		if theirs, found := remoteEntries[key]; found && !newerDigest(mine, theirs) {
+			continue
+		}
+
+		if err := cache.pace(limiter); err != nil {
+			return err
+		}
+		cache.pushTo(peer, key)
+	}
+
+	for key, theirs := range remoteEntries {
+		if mine, found := localEntries[key]; found && !newerDigest(theirs, mine) {
+			continue
+		}
+
+		if err := cache.pace(limiter); err != nil {
+			return err
+		}
+		cache.pullFrom(peer, key)
+	}
+
+	return nil
+}
+
+// pace waits for the next tick of the limiter, it gives up when the cache stops
+func (cache *distributedCache) pace(limiter *time.Ticker) error {
+	select {
+	case <-cache.ctx.Done():
+		return cache.ctx.Err()
+	case <-limiter.C:
+		return nil
+	}
+}
+
+// newerDigest tells whether a wins over b, higher version first, then a remove, and higher crc on a conflict as reads do
+func newerDigest(a merkleEntry, b merkleEntry) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+
+	if a.Deleted != b.Deleted {
+		return a.Deleted
+	}
+
+	return a.Crc > b.Crc
+}
+
+// pushTo sends the local copy or tombstone of a key to a peer which is missing it or holds an older one
+func (cache *distributedCache) pushTo(peer *cacheNode, key string) {
+	data, found := cache.local.lookup(key)
+	copy := cache.copyOf(key, peer.ID)
+	if !found || copy < 0 {
+		return
+	}
+
+	logMessage(LOG_DEBUG, "anti-entropy: pushing key: "+key+" to "+peer.ID)
+	ctx, cancel := cache.backgroundContext()
+	defer cancel()
+
+	if err := cache.putToNode(ctx, peer, copy, key, data); err != nil {
+		logMessage(LOG_ERROR, "anti-entropy: failed to push key: "+key+" to "+peer.ID)
+		return
+	}
+
+	cache.stats.syncKeys.Add(1)
+}
+
+// pullFrom fetches a key the local node is missing or holds an older copy of
+func (cache *distributedCache) pullFrom(peer *cacheNode, key string) {
+	copy := cache.copyOf(key, cache.local.ID)
+	if copy < 0 {
+		return
+	}
+
+	logMessage(LOG_DEBUG, "anti-entropy: pulling key: "+key+" from "+peer.ID)
+	ctx, cancel := cache.backgroundContext()
+	defer cancel()
+
+	read := cache.getFromNode(ctx, peer, cache.copyOf(key, peer.ID), key)
+	if read.data.tombstone() {
+		cache.local.delete(key, copy, read.data.version)
+		cache.stats.syncKeys.Add(1)
+		return
+	}
+
+	if read.err != nil || !read.found {
+		logMessage(LOG_ERROR, "anti-entropy: failed to pull key: "+key+" from "+peer.ID)
+		return
+	}
+
+	read.data.copy = copy
+	cache.local.put(key, read.data)
+	cache.stats.syncKeys.Add(1)
+}
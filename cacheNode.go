@@ -4,37 +4,89 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"hash/maphash"
 	"log"
 	"net/http"
 	"strconv"
-	"sync"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // nodeInfo contains information about a node in the cache cluster.
 type nodeInfo struct {
-	ID      string `json:"node_id"`
-	IP      string `json:"node_ip"`
-	Port    string `json:"node_port"`
-	GroupID string `json:"group_id"`
+	ID         string         `json:"node_id"`
+	IP         string         `json:"node_ip"`
+	Port       string         `json:"node_port"`
+	GroupID    string         `json:"group_id"`
+	Weight     int            `json:"weight,omitempty"`      // Relative share of the keyspace this node takes
+	VNodes     int            `json:"vnodes,omitempty"`      // Virtual nodes placed on the ring per unit of weight
+	Hasher     string         `json:"hasher,omitempty"`      // Name of the hasher used for ring placement
+	Placement  string         `json:"placement,omitempty"`   // Name of the placement algorithm picking owners of a key
+	HashTags   bool           `json:"hash_tags,omitempty"`   // Whether only the {tag} part of keys is hashed
+	LoadFactor float64        `json:"load_factor,omitempty"` // Bounded load capacity factor, 0 when loads are not bounded
+	Load       int            `json:"load,omitempty"`        // Number of keys held by the node when the heartbeat was sent, with bounded loads only those it owns
+	Overflow   map[string]int `json:"overflow,omitempty"`    // Owned keys which overflowed from a full node, counted per ID of that node
+	Zone       string         `json:"zone,omitempty"`        // Failure domain, replicas prefer distinct zones
+	Rack       string         `json:"rack,omitempty"`        // Failure domain within a zone, replicas prefer distinct racks
+	Leaving    bool           `json:"leaving,omitempty"`     // Node is handing its keys over and shutting down
 }
 
 // data cached per key
 type cacheData struct {
-	bytes []byte // Actual data recived for a given key
-	copy  int    // Copy factor of the data, 0 means you are master, > 0 means its a redundant copy
-	crc   uint32 // CRC32 checksum of the data
+	bytes   []byte    // Actual data recived for a given key
+	copy    int       // Copy factor of the data, 0 means you are master, > 0 means its a redundant copy
+	crc     uint32    // CRC32 checksum of the data
+	version uint64    // Version assigned by the node coordinating the write, newer write has a higher version
+	deleted time.Time // Set on tombstones, local time the key was removed
+	expires time.Time // Key is gone after this time, zero when it never expires
+}
+
+// tombstone tells whether the key was removed, a tombstone keeps the version of the remove and no bytes
+func (value cacheData) tombstone() bool {
+	return !value.deleted.IsZero()
+}
+
+// expired tells whether the key outlived its expiry time
+func (value cacheData) expired(now time.Time) bool {
+	return !value.expires.IsZero() && !now.Before(value.expires)
 }
 
 // cacheNode is a participating node in the cache cluster.
 type cacheNode struct {
 	nodeInfo // Information about the node
 
-	data map[string]cacheData // Stores the key-value pairs
-	mtx  sync.RWMutex         // Lock to protect the data
+	shards []*shard     // Stores the key-value pairs and tombstones of removed keys, a power of two of independently locked parts
+	seed   maphash.Seed // Seed of the hash picking the shard of a key
+	shared Store        // Store passed with WithStore and used by every shard, nil when each shard keeps a map
+	closed atomic.Bool  // Set once the shared store is closed
 
-	server *http.Server // HTTP server for the node to serve REST calls
+	maxBytes int          // Keys picked by the eviction policies are dropped beyond this size, 0 is unbounded
+	bytes    atomic.Int64 // Memory accounted to the keys and values of every shard
+
+	server *http.Server      // HTTP server for the node to serve REST calls
+	cache  *distributedCache // Cluster this node serves, only set on the node running in this process
+}
+
+const (
+	epochHeader   = "X-Vitarit-Epoch"   // Digest of the ring the responding node routes with
+	ownersHeader  = "X-Vitarit-Owners"  // Comma separated owners of the key as seen by the responding node
+	versionHeader = "X-Vitarit-Version" // Version of the value returned for a key
+	crcHeader     = "X-Vitarit-Crc"     // CRC32 of the value returned for a key
+	deletedHeader = "X-Vitarit-Deleted" // Set on a 404 when the node holds a tombstone of the key
+	expiresHeader = "X-Vitarit-Expires" // Expiry of the value returned for a key in Unix nanoseconds
+
+	shutdownTimeout     = 5 * time.Second  // Time given to requests in flight when the server stops
+	tlsHandshakeTimeout = 10 * time.Second // Time a peer is given to complete the TLS handshake
+	backgroundTimeout   = 10 * time.Second // Time a request no caller waits for may take when no request timeout is set
+)
+
+// newVersion returns version for a new write, wall clock in nanoseconds so the latest write wins
+func newVersion() uint64 {
+	return uint64(time.Now().UnixNano())
 }
 
 // -----------------------------------------------------------------------
@@ -43,87 +95,301 @@ type cacheNode struct {
 func newCacheNode(node nodeInfo) *cacheNode {
 	logMessage(LOG_DEBUG, "creating new cache node with id: "+node.ID)
 
-	return &cacheNode{
+	cnode := &cacheNode{
 		nodeInfo: node,
-		data:     make(map[string]cacheData),
+		seed:     maphash.MakeSeed(),
 		server:   nil,
 	}
+	cnode.split(defaultShards)
+
+	return cnode
 }
 
 // -----------------------------------------------------------------------
 
-// get retrieves the value of a key from the node
-func (cnode *cacheNode) get(key string) ([]byte, bool) {
-	cnode.mtx.RLock()
-	defer cnode.mtx.RUnlock()
+// get retrieves the value of a key from the node along with its version, removed keys are not found
+func (cnode *cacheNode) get(key string) (cacheData, bool) {
+	value, exists := cnode.lookup(key)
+	if value.tombstone() {
+		return cacheData{}, false
+	}
+
+	return value, exists
+}
+
+// lookup retrieves what the node holds for a key, the tombstone if it was removed
+// Expired keys are not found, the one just read is reclaimed on the way out
+func (cnode *cacheNode) lookup(key string) (cacheData, bool) {
+	now := time.Now()
+	sh := cnode.shardOf(key)
+
+	sh.mtx.RLock()
+	value, exists := sh.get(key)
+	sh.mtx.RUnlock()
+
+	if exists && value.expired(now) {
+		cnode.reclaim(key, now)
+		value, exists = cacheData{}, false
+	}
 
-	value, exists := cnode.data[key]
 	logMessage(LOG_DEBUG, cnode.ID+" get key: "+key+" Results"+fmt.Sprintf("%v", exists))
 
-	return value.bytes, exists
+	return value, exists
+}
+
+// reclaim drops a key if it is still expired, it may have been written again since it was read
+func (cnode *cacheNode) reclaim(key string, now time.Time) bool {
+	sh := cnode.shardOf(key)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	if value, exists := sh.get(key); exists && value.expired(now) {
+		logMessage(LOG_DEBUG, cnode.ID+" key: "+key+" expired")
+		return sh.drop(key)
+	}
+
+	return false
+}
+
+// digests returns version and crc of every key stored on the node, tombstones included
+// Shards are read one after the other, so the result is not a snapshot of the node at one instant
+func (cnode *cacheNode) digests() []merkleEntry {
+	now := time.Now()
+	entries := make([]merkleEntry, 0, cnode.count())
+
+	cnode.scan(func(key string, value cacheData) bool {
+		if !value.expired(now) {
+			entries = append(entries, merkleEntry{Key: key, Version: value.version, Crc: value.crc, Deleted: value.tombstone()})
+		}
+		return true
+	})
+
+	return entries
+}
+
+// count returns number of live keys stored on the node
+func (cnode *cacheNode) count() int {
+	count := 0
+	for _, sh := range cnode.shards {
+		sh.mtx.RLock()
+		count += sh.keys - sh.tombstones
+		sh.mtx.RUnlock()
+	}
+
+	return count
+}
+
+// set sets the value of a key in the node, a write older than the stored version or tombstone is ignored
+func (cnode *cacheNode) set(key string, copy int, value []byte, version uint64) error {
+	return cnode.put(key, cacheData{
+		bytes:   value,
+		copy:    copy,
+		version: version,
+	})
 }
 
-// set sets the value of a key in the node
-func (cnode *cacheNode) set(key string, copy int, value []byte) {
-	cnode.mtx.Lock()
-	defer cnode.mtx.Unlock()
+// put stores a value with its version and expiry, a write older than the stored version or tombstone is ignored
+func (cnode *cacheNode) put(key string, value cacheData) error {
+	sh := cnode.shardOf(key)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	if sh.supersedes(key, value.version) {
+		logMessage(LOG_DEBUG, cnode.ID+" ignoring stale set key: "+key)
+		return nil
+	}
 
-	cnode.data[key] = cacheData{
-		bytes: value,
-		copy:  copy,
-		crc:   crc32.ChecksumIEEE(value),
+	value.crc = crc32.ChecksumIEEE(value.bytes)
+	if err := sh.store(key, value); err != nil {
+		return err
 	}
 
 	logMessage(LOG_DEBUG, cnode.ID+" set key: "+key)
+	return nil
 }
 
-// remove deletes a key from the node
-func (cnode *cacheNode) remove(key string) {
-	cnode.mtx.Lock()
-	defer cnode.mtx.Unlock()
+// delete replaces the value of a key with a tombstone, a remove older than the stored version is ignored
+// Tombstone stays until purged so a late write or a replica still holding the value cannot bring the key back
+func (cnode *cacheNode) delete(key string, copy int, version uint64) error {
+	sh := cnode.shardOf(key)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	if existing, found := sh.get(key); found && existing.version > version {
+		logMessage(LOG_DEBUG, cnode.ID+" ignoring stale remove key: "+key)
+		return nil
+	}
+
+	err := sh.store(key, cacheData{
+		copy:    copy,
+		version: version,
+		deleted: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
 
-	delete(cnode.data, key)
 	logMessage(LOG_DEBUG, cnode.ID+" remove key: "+key)
+	return nil
+}
+
+// purge drops tombstones of keys removed before the given time and returns how many were dropped
+// Tombstones are found first and dropped after, each under the lock of its shard once it is checked again
+func (cnode *cacheNode) purge(before time.Time) int {
+	old := []string{}
+	cnode.scan(func(key string, value cacheData) bool {
+		if value.tombstone() && value.deleted.Before(before) {
+			old = append(old, key)
+		}
+		return true
+	})
+
+	purged := 0
+	for _, key := range old {
+		sh := cnode.shardOf(key)
+		sh.mtx.Lock()
+		if value, found := sh.get(key); found && value.tombstone() && value.deleted.Before(before) && sh.drop(key) {
+			purged++
+		}
+		sh.mtx.Unlock()
+	}
+
+	return purged
+}
+
+// setCopy changes which copy of a key this node holds after ownership moved
+func (cnode *cacheNode) setCopy(key string, copy int) {
+	sh := cnode.shardOf(key)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	if value, found := sh.get(key); found {
+		value.copy = copy
+		if sh.store(key, value) == nil {
+			logMessage(LOG_DEBUG, cnode.ID+" key: "+key+" is now copy "+fmt.Sprintf("%d", copy))
+		}
+	}
+}
+
+// remove drops a key or its tombstone from the node, used once the node no longer owns the key
+func (cnode *cacheNode) remove(key string) {
+	sh := cnode.shardOf(key)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	sh.drop(key)
+	logMessage(LOG_DEBUG, cnode.ID+" drop key: "+key)
 }
 
 // -----------------------------------------------------------------------
 
 // start starts the server for this node
 func (cnode *cacheNode) start() {
+	cnode.server = &http.Server{
+		Addr:    cnode.IP + ":" + cnode.Port,
+		Handler: cnode.handler(),
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
 	go cnode.startServer()
 }
 
 // stop stops the server for this node
 func (cnode *cacheNode) stop() {
-	cnode.server.Shutdown(context.TODO())
+	if cnode.server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := cnode.server.Shutdown(ctx); err != nil {
+		logMessage(LOG_ERROR, cnode.ID+" failed to shutdown https server: "+err.Error())
+	}
 }
 
 // -----------------------------------------------------------------------
 
-// startServer starts the server for this node and listens for incoming requests
-func (cnode *cacheNode) startServer() {
+// handler returns the routes served by this node
+func (cnode *cacheNode) handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", cnode.ServeHTTP)
+	mux.HandleFunc("/merkle", cnode.serveMerkle)
 
-	cnode.server = &http.Server{
-		Addr:    cnode.IP + ":" + cnode.Port,
-		Handler: mux,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		},
-	}
+	return mux
+}
 
+// startServer starts the server for this node and listens for incoming requests
+func (cnode *cacheNode) startServer() {
 	logMessage(LOG_DEBUG, cnode.ID+" starting https server")
 
 	err := cnode.server.ListenAndServeTLS("cert.pem", "key.pem")
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server failed to start: %v", err)
 	}
 }
 
 // -----------------------------------------------------------------------
+
+// ownerOnly tells whether the request is a write only the owner of the key decides on
+// Such a write is checked and applied under the lock of one node, a replica serving it would race the owner
+func ownerOnly(r *http.Request) bool {
+	query := r.URL.Query()
+	return r.Method == http.MethodPost && (query.Get("if") != "" || query.Has("incr") || query.Has("touch"))
+}
+
+// misdirected tells whether the caller routed this request with a different ring and this node does not own the key
+// In that case the owners seen by this node are returned so that the caller can re-resolve the target
+// A write only the owner decides on is redirected unless this node is the owner, holding a copy is not enough
+func (cnode *cacheNode) misdirected(w http.ResponseWriter, r *http.Request) bool {
+	if cnode.cache == nil {
+		return false
+	}
+
+	epoch := cnode.cache.epoch()
+	w.Header().Set(epochHeader, epoch.Digest)
+
+	callerEpoch := r.URL.Query().Get("epoch")
+	if callerEpoch == "" || callerEpoch == epoch.Digest {
+		return false
+	}
+
+	key := r.URL.Query().Get("key")
+	owners := cnode.cache.placementOf(key)
+
+	ids := make([]string, 0, len(owners))
+	for copy, owner := range owners {
+		if owner.ID == cnode.ID && (copy == 0 || !ownerOnly(r)) {
+			// Rings differ but this node owns the key in both, serve it
+			return false
+		}
+		ids = append(ids, owner.ID)
+	}
+
+	logMessage(LOG_WARNING, cnode.ID+" received key: "+key+" routed with epoch "+callerEpoch+" while at "+epoch.Digest)
+	w.Header().Set(ownersHeader, strings.Join(ids, ","))
+	w.WriteHeader(http.StatusMisdirectedRequest)
+
+	return true
+}
+
+// writeValue answers with the value the owner stored, version and expiry go in headers and the bytes in the body
+func writeValue(w http.ResponseWriter, data cacheData) {
+	w.Header().Set(versionHeader, strconv.FormatUint(data.version, 10))
+	if !data.expires.IsZero() {
+		w.Header().Set(expiresHeader, strconv.FormatInt(data.expires.UnixNano(), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data.bytes)
+}
+
 // serveHTTP handles the HTTP requests coming to this particular node
 func (cnode *cacheNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if cnode.misdirected(w, r) {
+		return
+	}
 
 	switch r.Method {
 
@@ -134,10 +400,22 @@ func (cnode *cacheNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		logMessage(LOG_DEBUG, cnode.ID+" received get key: "+key+" from "+id)
 
-		value, exists := cnode.get(key)
-		if exists {
+		value, exists := cnode.lookup(key)
+		cnode.used(key, exists && !value.tombstone())
+
+		if exists && value.tombstone() {
+			// Version of the remove lets readers tell a removed key from one this node never saw
+			w.Header().Set(versionHeader, strconv.FormatUint(value.version, 10))
+			w.Header().Set(deletedHeader, "true")
+			w.WriteHeader(http.StatusNotFound)
+		} else if exists {
+			w.Header().Set(versionHeader, strconv.FormatUint(value.version, 10))
+			w.Header().Set(crcHeader, strconv.FormatUint(uint64(value.crc), 10))
+			if !value.expires.IsZero() {
+				w.Header().Set(expiresHeader, strconv.FormatInt(value.expires.UnixNano(), 10))
+			}
 			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(value))
+			w.Write(value.bytes)
 		} else {
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -152,6 +430,28 @@ func (cnode *cacheNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Writes without a version come from older nodes, version them on arrival
+		version, _ := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+		if version == 0 {
+			version = newVersion()
+		}
+
+		if r.URL.Query().Has("incr") {
+			cnode.serveIncr(w, r)
+			return
+		}
+
+		if r.URL.Query().Has("touch") {
+			cnode.serveTouch(w, r)
+			return
+		}
+
+		// Writes carrying an expiry keep it on every copy
+		var expires time.Time
+		if nanos, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64); nanos > 0 {
+			expires = time.Unix(0, nanos)
+		}
+
 		// Set value corrosponding to a key in the node
 		var kv map[string][]byte
 		if err := json.NewDecoder(r.Body).Decode(&kv); err != nil {
@@ -159,17 +459,41 @@ func (cnode *cacheNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if cond := r.URL.Query().Get("if"); cond != "" {
+			// Conditional write, the precondition is checked against a single key
+			cnode.serveSetIf(w, kv, copy, precondition(cond))
+			return
+		}
+
 		for key, value := range kv {
 			logMessage(LOG_DEBUG, cnode.ID+" received set key: "+key+" from "+id+" with copy factor "+fmt.Sprintf("%d", copy))
-			cnode.set(key, copy, value)
+			if err := cnode.put(key, cacheData{bytes: value, copy: copy, version: version, expires: expires}); errors.Is(err, errTooLarge) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 		}
 		w.WriteHeader(http.StatusOK)
 
 	case http.MethodDelete:
-		// Remove a key from the node
+		// Remove a key from the node, requests without copy or version come from older nodes
 		key := r.URL.Query().Get("key")
-		logMessage(LOG_DEBUG, cnode.ID+" received remove key: "+key)
-		cnode.remove(key)
+		id := r.URL.Query().Get("id")
+		copy, _ := strconv.Atoi(r.URL.Query().Get("copy"))
+
+		version, _ := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+		if version == 0 {
+			version = newVersion()
+		}
+
+		logMessage(LOG_DEBUG, cnode.ID+" received remove key: "+key+" from "+id+" with copy factor "+fmt.Sprintf("%d", copy))
+		if err := cnode.delete(key, copy, version); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
 
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -0,0 +1,147 @@
+package vitarit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrConflict is returned when the precondition of a conditional write does not hold on the owner of the key
+var ErrConflict = errors.New("precondition failed")
+
+// errInvalidPrecondition tells a node received a precondition it cannot parse
+var errInvalidPrecondition = errors.New("invalid precondition")
+
+// precondition a conditional write has to meet on the owner of the key, sent in the "if" query parameter
+// It is either absent, present, or the version the key must be at where version 0 means absent
+type precondition string
+
+const (
+	ifAbsent  precondition = "absent"  // Key must not exist, a tombstone counts as absent
+	ifPresent precondition = "present" // Key must exist
+)
+
+// ifVersion returns precondition holding when the key is at the given version
+func ifVersion(version uint64) precondition {
+	return precondition(strconv.FormatUint(version, 10))
+}
+
+// holds tells whether the precondition is met by what the node holds for the key
+func (cond precondition) holds(existing cacheData, found bool) (bool, error) {
+	live := found && !existing.tombstone() && !existing.expired(time.Now())
+
+	switch cond {
+	case ifAbsent:
+		return !live, nil
+	case ifPresent:
+		return live, nil
+	}
+
+	version, err := strconv.ParseUint(string(cond), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("%w %q", errInvalidPrecondition, string(cond))
+	}
+
+	if !live {
+		return version == 0, nil
+	}
+
+	return existing.version == version, nil
+}
+
+// -----------------------------------------------------------------------
+
+// setIf sets the value of a key only when the precondition holds, check and write happen under one lock
+// The write gets a version newer than the one it replaces, it returns what the node holds afterwards
+func (cnode *cacheNode) setIf(key string, copy int, value []byte, cond precondition) (cacheData, bool, error) {
+	sh := cnode.shardOf(key)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	existing, found := sh.get(key)
+	ok, err := cond.holds(existing, found)
+	if err != nil || !ok {
+		logMessage(LOG_DEBUG, cnode.ID+" precondition "+string(cond)+" failed for key: "+key)
+		return existing, false, err
+	}
+
+	data := cacheData{
+		bytes:   value,
+		copy:    copy,
+		crc:     crc32.ChecksumIEEE(value),
+		version: max(newVersion(), existing.version+1),
+	}
+	if err := sh.store(key, data); err != nil {
+		return existing, false, err
+	}
+
+	logMessage(LOG_DEBUG, cnode.ID+" set key: "+key+" on precondition "+string(cond))
+	return data, true, nil
+}
+
+// serveSetIf answers a conditional write with the value written and its version
+// 412 tells the precondition did not hold, the version is then the current one or 0 when the key is absent
+func (cnode *cacheNode) serveSetIf(w http.ResponseWriter, kv map[string][]byte, copy int, cond precondition) {
+	if len(kv) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for key, value := range kv {
+		logMessage(LOG_DEBUG, cnode.ID+" received set key: "+key+" if "+string(cond))
+
+		data, ok, err := cnode.setIf(key, copy, value, cond)
+		if errors.Is(err, errInvalidPrecondition) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !ok {
+			version := data.version
+			if data.tombstone() {
+				version = 0
+			}
+
+			w.Header().Set(versionHeader, strconv.FormatUint(version, 10))
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		writeValue(w, data)
+	}
+}
+
+// -----------------------------------------------------------------------
+
+// createURLForSetIf creates a URL for a conditional write, the owner assigns the version
+func createURLForSetIf(cnode *cacheNode, key string, cond precondition, epoch string) string {
+	return fmt.Sprintf("https://%s:%s?id=%s&key=%s&copy=0&if=%s&epoch=%s", cnode.IP, cnode.Port, cnode.ID, url.QueryEscape(key), url.QueryEscape(string(cond)), epoch)
+}
+
+// setIf writes a key when the precondition holds on its owner, the only node that can check it atomically, and replicates it
+func (cache *distributedCache) setIf(key string, value []byte, cond precondition) (uint64, error) {
+	body, _ := json.Marshal(map[string][]byte{key: value})
+
+	data, err := cache.writeOnOwner(key, ownerWrite{
+		op:   "set",
+		body: body,
+		url: func(cnode *cacheNode, epoch string) string {
+			return createURLForSetIf(cnode, key, cond, epoch)
+		},
+		refused: func(status int, current cacheData) error {
+			if status == http.StatusPreconditionFailed {
+				return fmt.Errorf("%w: key %s is at version %d", ErrConflict, key, current.version)
+			}
+			return nil
+		},
+	}, cache.config.callOptions())
+
+	return data.version, err
+}
@@ -0,0 +1,166 @@
+package vitarit
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrNotCounter is returned when Incr or Decr finds a value which is not a decimal integer, or would overflow it
+var ErrNotCounter = errors.New("value is not a counter")
+
+// CounterOption configures a single Incr or Decr call
+type CounterOption func(*counterOptions)
+
+// counterOptions apply when the counter does not exist yet
+type counterOptions struct {
+	initial int64         // Value the delta is applied to
+	ttl     time.Duration // Lifetime of the counter, 0 keeps it until removed
+}
+
+// WithInitialValue sets the value a missing counter starts from, the delta is applied on top of it
+func WithInitialValue(value int64) CounterOption {
+	return func(opts *counterOptions) {
+		opts.initial = value
+	}
+}
+
+// WithCounterTTL makes a counter created by this call expire after ttl, an existing counter keeps its expiry
+func WithCounterTTL(ttl time.Duration) CounterOption {
+	return func(opts *counterOptions) {
+		if ttl > 0 {
+			opts.ttl = ttl
+		}
+	}
+}
+
+// -----------------------------------------------------------------------
+
+// addDelta adds delta to a counter, failing when the sum does not fit an int64
+func addDelta(current int64, delta int64) (int64, error) {
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, fmt.Errorf("%w: %d%+d overflows", ErrNotCounter, current, delta)
+	}
+
+	return current + delta, nil
+}
+
+// incr applies delta to the counter stored under key, check and write happen under one lock
+// A missing, removed or expired counter starts from the initial value and takes the ttl
+func (cnode *cacheNode) incr(key string, copy int, delta int64, opts counterOptions) (cacheData, error) {
+	sh := cnode.shardOf(key)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	now := time.Now()
+	current := opts.initial
+	var expires time.Time
+
+	existing, live := sh.live(key, now)
+	if live {
+		parsed, err := strconv.ParseInt(string(existing.bytes), 10, 64)
+		if err != nil {
+			logMessage(LOG_DEBUG, cnode.ID+" cannot increment key: "+key+", it is not a counter")
+			return existing, ErrNotCounter
+		}
+
+		current, expires = parsed, existing.expires
+	} else if opts.ttl > 0 {
+		expires = now.Add(opts.ttl)
+	}
+
+	next, err := addDelta(current, delta)
+	if err != nil {
+		logMessage(LOG_DEBUG, cnode.ID+" cannot increment key: "+key+": "+err.Error())
+		return existing, err
+	}
+
+	// A removed key keeps the version of its tombstone, the counter has to be newer
+	previous, _ := sh.get(key)
+
+	value := []byte(strconv.FormatInt(next, 10))
+	data := cacheData{
+		bytes:   value,
+		copy:    copy,
+		crc:     crc32.ChecksumIEEE(value),
+		version: max(newVersion(), previous.version+1),
+		expires: expires,
+	}
+	if err := sh.store(key, data); err != nil {
+		return existing, err
+	}
+
+	logMessage(LOG_DEBUG, cnode.ID+" incremented key: "+key+" to "+string(value))
+	return data, nil
+}
+
+// serveIncr answers an increment with the new value in the body along with its version and expiry
+// 422 tells the stored value is not a counter, 500 that the node failed to store the new value
+func (cnode *cacheNode) serveIncr(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	copy, _ := strconv.Atoi(query.Get("copy"))
+
+	delta, err := strconv.ParseInt(query.Get("incr"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var opts counterOptions
+	opts.initial, _ = strconv.ParseInt(query.Get("initial"), 10, 64)
+	if ttl, _ := strconv.ParseInt(query.Get("ttl"), 10, 64); ttl > 0 {
+		opts.ttl = time.Duration(ttl)
+	}
+
+	logMessage(LOG_DEBUG, cnode.ID+" received incr key: "+key+" by "+strconv.FormatInt(delta, 10))
+
+	data, err := cnode.incr(key, copy, delta, opts)
+	if errors.Is(err, ErrNotCounter) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, err.Error())
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeValue(w, data)
+}
+
+// -----------------------------------------------------------------------
+
+// createURLForIncr creates a URL to increment a counter on the owner of the key
+func createURLForIncr(cnode *cacheNode, key string, delta int64, opts counterOptions, epoch string) string {
+	return fmt.Sprintf("https://%s:%s?id=%s&key=%s&copy=0&incr=%d&initial=%d&ttl=%d&epoch=%s", cnode.IP, cnode.Port, cnode.ID, url.QueryEscape(key), delta, opts.initial, int64(opts.ttl), epoch)
+}
+
+// incr increments a counter on the owner of the key, the only node that can increment atomically, and replicates the new value
+func (cache *distributedCache) incr(key string, delta int64, opts ...CounterOption) (int64, error) {
+	var options counterOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	data, err := cache.writeOnOwner(key, ownerWrite{
+		op: "increment",
+		url: func(cnode *cacheNode, epoch string) string {
+			return createURLForIncr(cnode, key, delta, options, epoch)
+		},
+		refused: func(status int, _ cacheData) error {
+			if status == http.StatusUnprocessableEntity {
+				return fmt.Errorf("%w: key %s", ErrNotCounter, key)
+			}
+			return nil
+		},
+	}, cache.config.callOptions())
+
+	value, _ := strconv.ParseInt(string(data.bytes), 10, 64)
+	return value, err
+}
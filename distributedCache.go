@@ -2,21 +2,45 @@ package vitarit
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrWriteQuorum is returned when fewer nodes than the write quorum acknowledged a write
+var ErrWriteQuorum = errors.New("write quorum not reached")
+
 // distributedCache is a distributed cache that uses consistent hashing
 type distributedCache struct {
 	*hashRing      // Consistent hash ring
 	*peerDiscovery // Peer discovery module
 
-	redundancy int // mentions how many copies of data should be stored
+	redundancy int        // mentions how many copies of data should be stored
+	config     config     // Tunables of this instance
+	stats      cacheStats // Counters reported through Stats
+	hints      *hintStore // Writes waiting for unreachable owners
+
+	local   *cacheNode  // Node running in this process, set when the cache starts
+	syncing sync.Mutex  // Held while an anti-entropy round is running
+	leaving atomic.Bool // Set once this node announced it is leaving
+
+	rebalanceFrom   *hashRing          // Placement before the pending membership changes
+	rebalanceTimer  *time.Timer        // Fires the pending rebalance once membership settles
+	rebalanceMtx    sync.Mutex         // Lock to protect the pending rebalance
+	rebalancing     sync.Mutex         // Held while keys are being moved
+	rebalanceCtx    context.Context    // Bounds the requests of a rebalance, cancelled when the cache stops
+	rebalanceCancel context.CancelFunc // Cancels rebalanceCtx
 
 	nodeHB map[string]time.Time // Map of nodeID to heartbeat status
 	mtx    sync.RWMutex         // Lock to protect the nodeHB
@@ -25,9 +49,9 @@ type distributedCache struct {
 // -----------------------------------------------------------------------
 
 // newDistributedCache allocates a new distributed cache
-func newDistributedCache(redundancy int) *distributedCache {
+func newDistributedCache(redundancy int, cfg config) *distributedCache {
 	cache := &distributedCache{
-		hashRing: NewHashRing(),
+		hashRing: NewHashRing(cfg),
 		peerDiscovery: &peerDiscovery{
 			client:   nil,
 			sendConn: nil,
@@ -35,14 +59,21 @@ func newDistributedCache(redundancy int) *distributedCache {
 		},
 
 		redundancy: redundancy,
+		config:     cfg,
+		hints:      newHintStore(cfg.hintBytes, cfg.hintTTL),
 		nodeHB:     make(map[string]time.Time),
 	}
+	cache.ctx, cache.cancel = context.WithCancel(context.Background())
+	cache.rebalanceCtx, cache.rebalanceCancel = context.WithCancel(context.Background())
 
+	// Requests are bounded by the context they are sent with, a dial left behind by a cancelled request
+	// still gives up on a peer that never completes the handshake
 	cache.client = &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: true,
 			},
+			TLSHandshakeTimeout: tlsHandshakeTimeout,
 		},
 	}
 
@@ -59,12 +90,51 @@ func (cache *distributedCache) start(node nodeInfo) {
 		return
 	}
 
+	// Local node consults the ring to detect requests routed with a different membership
+	cnode.cache = cache
+	cache.local = cnode
+	cnode.split(cache.config.shards)
+	if cache.config.store != nil {
+		cnode.attach(cache.config.store)
+	}
+	cnode.bound(cache.config.maxBytes, cache.config.eviction)
 	cnode.start()
 	cache.startDiscovery(cnode.nodeInfo)
+
+	go cache.runAntiEntropy()
+	go cache.runSweeper()
 }
 
+// stop ends peer discovery, anti-entropy and any pending rebalance, then shuts the server down and closes the store
 func (cache *distributedCache) stop() {
-	cache.stopDiscovery()
+	if err := cache.stopDiscovery(); err != nil {
+		logMessage(LOG_ERROR, "failed to stop peer discovery: "+err.Error())
+	}
+
+	cache.rebalanceMtx.Lock()
+	if cache.rebalanceTimer != nil {
+		cache.rebalanceTimer.Stop()
+		cache.rebalanceTimer = nil
+	}
+	cache.rebalanceFrom = nil
+	cache.rebalanceMtx.Unlock()
+
+	// Rebalance in progress gives up at its next key, the store is closed only once it returned
+	cache.rebalanceCancel()
+	cache.rebalancing.Lock()
+	cache.rebalancing.Unlock()
+
+	// Anti-entropy round in progress was cancelled with discovery, it must not pull keys into a closed store
+	cache.syncing.Lock()
+	cache.syncing.Unlock()
+
+	if cache.local != nil {
+		cache.local.stop()
+
+		if err := cache.local.closeStore(); err != nil {
+			logMessage(LOG_ERROR, "failed to close store of "+cache.local.ID+": "+err.Error())
+		}
+	}
 }
 
 // -----------------------------------------------------------------------
@@ -76,154 +146,582 @@ func (cache *distributedCache) addNode(node nodeInfo) {
 
 	if _, found := cache.nodeHB[node.ID]; !found {
 		logMessage(LOG_DEBUG, "adding node "+node.ID+" to the cache")
+		cache.ringChanging()
 		cache.hashRing.addNode(node)
+	} else {
+		// Known node, its heartbeat only refreshes the advertised load
+		cache.refreshLoad_unlocked(node.ID, node.Load, node.Overflow)
 	}
 
 	cache.nodeHB[node.ID] = time.Now()
 
+	// Node is reachable again, hand over the writes it missed
+	if cache.hints.pending(node.ID) {
+		go cache.replayHints(node.ID)
+	}
 }
 
 // removeNode removes a node from the distributed cache
+// Copies the node held are re-created on the next owners by the rebalance that follows
 func (cache *distributedCache) removeNode_unlocked(nodeID string) {
 	delete(cache.nodeHB, nodeID)
+	cache.ringChanging()
 	cache.hashRing.removeNode(nodeID)
 }
 
+// refreshLoad records the load a node advertised, caller shall hold the cache lock
+// When a node becomes full, no longer full or keeps another share of its keys, keys get other owners,
+// they are moved like after a membership change
+func (cache *distributedCache) refreshLoad_unlocked(nodeID string, load int, overflow map[string]int) {
+	if cache.hashRing.overflows(nodeID, load, overflow) {
+		logMessage(LOG_INFO, "bounded load of "+nodeID+" changed owners of its keys")
+		cache.ringChanging()
+	}
+
+	cache.hashRing.setLoad(nodeID, load, overflow)
+}
+
+// localLoad returns number of keys held by the node running in this process
+// With bounded loads only the keys it owns are counted, along with how many of them overflowed from each full node
+func (cache *distributedCache) localLoad(nodeID string) (int, map[string]int) {
+	cnode := cache.getNodeByID(nodeID)
+	if cnode == nil {
+		return 0, nil
+	}
+
+	if cache.hashRing.loadFactor <= 0 {
+		return cnode.count(), nil
+	}
+
+	now := time.Now()
+	owned := []string{}
+	cnode.scan(func(key string, value cacheData) bool {
+		if value.copy == 0 && !value.tombstone() && !value.expired(now) {
+			owned = append(owned, key)
+		}
+		return true
+	})
+
+	return cache.hashRing.ownedLoad(nodeID, owned)
+}
+
 // -----------------------------------------------------------------------
 // List all the discovered peers
 func (cache *distributedCache) getPeers() []nodeInfo {
 	cache.mtx.RLock()
 	defer cache.mtx.RUnlock()
 
-	peers := make([]nodeInfo, 0)
-	for _, node := range cache.hashRing.nodes {
-		peers = append(peers, node.nodeInfo)
-	}
+	return cache.hashRing.members()
+}
 
-	return peers
+// placementOf returns the nodes chosen for a key, owner first followed by the redundant copies
+func (cache *distributedCache) placementOf(key string) []nodeInfo {
+	return cache.hashRing.locate(key, cache.redundancy)
 }
 
 // -----------------------------------------------------------------------
 
-// createURL creates a URL for a key on a node
-func createURL(cnode *cacheNode, key string) string {
-	return fmt.Sprintf("https://%s:%s?id=%s&key=%s", cnode.IP, cnode.Port, cnode.ID, key)
+// createURL creates a URL for a key on a node, epoch is digest of the ring the request was routed with
+func createURL(cnode *cacheNode, key string, epoch string) string {
+	return fmt.Sprintf("https://%s:%s?id=%s&key=%s&epoch=%s", cnode.IP, cnode.Port, cnode.ID, url.QueryEscape(key), epoch)
 }
 
-// createURLForRedundancy creates a URL to store a key on the node with the redundancy factor
-func createURLForSet(cnode *cacheNode, key string, copy int) string {
-	return fmt.Sprintf("https://%s:%s?id=%s&copy=%d", cnode.IP, cnode.Port, cnode.ID, copy)
+// createURLForRedundancy creates a URL to store a version of a key on the node with the redundancy factor
+func createURLForSet(cnode *cacheNode, key string, copy int, version uint64, epoch string) string {
+	return fmt.Sprintf("https://%s:%s?id=%s&key=%s&copy=%d&version=%d&epoch=%s", cnode.IP, cnode.Port, cnode.ID, url.QueryEscape(key), copy, version, epoch)
+}
+
+// send issues a request built by createURL for a key to a node
+// If the node routes the key with a different ring it answers with its owners of the key,
+// the request is then sent once more to the node holding the same copy in that ring
+func (cache *distributedCache) send(ctx context.Context, cnode *cacheNode, method string, copy int, body []byte, createURL func(*cacheNode) string) (*http.Response, error) {
+	resp, err := cache.sendOnce(ctx, cnode, method, body, createURL)
+	if err != nil || resp.StatusCode != http.StatusMisdirectedRequest {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	owners := strings.Split(resp.Header.Get(ownersHeader), ",")
+	logMessage(LOG_WARNING, "ring epoch mismatch with "+cnode.ID+", its owners are "+resp.Header.Get(ownersHeader))
+
+	if copy < 0 || copy >= len(owners) {
+		copy = 0
+	}
+
+	target := cache.getNodeByID(owners[copy])
+	if target == nil || target == cnode {
+		return nil, fmt.Errorf("%s redirected to unknown owner %s", cnode.ID, owners[copy])
+	}
+
+	logMessage(LOG_DEBUG, "re-sending request to "+target.ID)
+	return cache.sendOnce(ctx, target, method, body, createURL)
+}
+
+func (cache *distributedCache) sendOnce(ctx context.Context, cnode *cacheNode, method string, body []byte, createURL func(*cacheNode) string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewBuffer(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, createURL(cnode), reader)
+	if err != nil {
+		logMessage(LOG_ERROR, "failed to create request: "+err.Error())
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return cache.client.Do(req)
 }
 
 // -----------------------------------------------------------------------
 
+// replicaRead is the answer of one copy to a get
+type replicaRead struct {
+	node  *cacheNode // Node that was asked
+	copy  int        // Copy of the key this node holds
+	data  cacheData  // Value, version and crc when found, version of the remove on a tombstone
+	found bool       // Node answered and has the key, false on a tombstone
+	err   error      // Node did not answer
+}
+
 // Get retrieves the value of a key from the distributed cache
-func (cache *distributedCache) get(key string) ([]byte, bool) {
+func (cache *distributedCache) get(key string, opts ...CallOption) ([]byte, bool) {
+	data, found := cache.read(key, opts...)
+	if !found {
+		return []byte{}, false
+	}
+
+	return data.bytes, true
+}
+
+// read retrieves the value of a key along with its version
+// With consistency ONE copies are tried in order, otherwise R copies are queried concurrently and the newest version wins
+func (cache *distributedCache) read(key string, opts ...CallOption) (cacheData, bool) {
+	options := cache.config.callOptions(opts...)
+	ctx, cancel := options.context()
+	defer cancel()
+
 	nodes := cache.hashRing.getNodes(key, cache.redundancy)
 
-	for idx, node := range nodes {
-		logMessage(LOG_DEBUG, "sending get for key "+key+" to "+node.ID+" try "+fmt.Sprintf("%d", idx))
-		data, err := cache.getFromNode(node, key)
-		if err != nil {
-			logMessage(LOG_ERROR, "failed to get key: "+key+" from "+node.ID)
+	if options.consistency == ConsistencyOne {
+		for idx, node := range nodes {
+			logMessage(LOG_DEBUG, "sending get for key "+key+" to "+node.ID+" try "+fmt.Sprintf("%d", idx))
+			read := cache.getFromNode(ctx, node, idx, key)
+			if read.data.tombstone() {
+				// Key was removed, copies further down may not have seen the remove yet
+				return cacheData{}, false
+			}
+
+			if read.err != nil || !read.found {
+				logMessage(LOG_ERROR, "failed to get key: "+key+" from "+node.ID)
+				continue
+			}
+
+			return read.data, true
+		}
+
+		return cacheData{}, false
+	}
+
+	replies := cache.readReplicas(ctx, key, nodes, options.consistency.replicas(len(nodes)))
+	if replies == nil {
+		return cacheData{}, false
+	}
+
+	newest, found := cache.reconcile(key, replies)
+	if !found {
+		return cacheData{}, false
+	}
+
+	go cache.readRepair(key, newest, replies)
+
+	if newest.data.tombstone() {
+		return cacheData{}, false
+	}
+
+	return newest.data, true
+}
+
+// readReplicas queries r copies concurrently, a copy that does not answer is replaced by the next one
+// It returns nil when fewer than r copies answered
+func (cache *distributedCache) readReplicas(ctx context.Context, key string, nodes []*cacheNode, r int) []replicaRead {
+	results := make(chan replicaRead, len(nodes))
+
+	next := 0
+	launch := func() {
+		logMessage(LOG_DEBUG, "sending get for key "+key+" to "+nodes[next].ID)
+		go func(cnode *cacheNode, copy int) {
+			results <- cache.getFromNode(ctx, cnode, copy, key)
+		}(nodes[next], next)
+		next++
+	}
+
+	for next < r && next < len(nodes) {
+		launch()
+	}
+
+	replies := make([]replicaRead, 0, r)
+	for pending := next; pending > 0 && len(replies) < r; pending-- {
+		read := <-results
+		if read.err != nil {
+			if next < len(nodes) {
+				launch()
+				pending++
+			}
 			continue
 		}
 
-		return data, true
+		replies = append(replies, read)
 	}
 
-	return []byte{}, false
+	if len(replies) < r {
+		logMessage(LOG_ERROR, "failed to get key: "+key+", "+fmt.Sprintf("%d of %d", len(replies), r)+" copies answered")
+		return nil
+	}
+
+	return replies
 }
 
-// get key from a node which might own this cache key
+// reconcile picks the newest version among the answers, which is a tombstone when the newest write was a remove
+// Same version with different content is a conflict, it is counted and the higher crc wins so every reader picks the same
+func (cache *distributedCache) reconcile(key string, replies []replicaRead) (replicaRead, bool) {
+	var newest replicaRead
+	found := false
 
-func (cache *distributedCache) getFromNode(cnode *cacheNode, key string) ([]byte, error) {
+	for _, read := range replies {
+		if !read.found && !read.data.tombstone() {
+			continue
+		}
+
+		if !found || read.data.version > newest.data.version {
+			newest, found = read, true
+			continue
+		}
 
-	url := createURL(cnode, key)
-	resp, err := cache.client.Get(url)
+		if read.data.version != newest.data.version {
+			continue
+		}
 
-	if err != nil || resp.StatusCode != http.StatusOK {
+		if read.data.tombstone() || newest.data.tombstone() {
+			// Remove wins over a write carrying the same version
+			if read.data.tombstone() {
+				newest = read
+			}
+			continue
+		}
+
+		if read.data.crc != newest.data.crc {
+			logMessage(LOG_WARNING, "conflicting copies of key: "+key+" on "+newest.node.ID+" and "+read.node.ID)
+			cache.stats.readConflicts.Add(1)
+
+			if read.data.crc > newest.data.crc {
+				newest = read
+			}
+		}
+	}
+
+	return newest, found
+}
+
+// backgroundContext bounds a request sent after its caller returned, by the request timeout or backgroundTimeout without one
+// A peer that accepts the connection but never answers would otherwise hold the goroutine forever, stopping the cache
+// cancels it as well
+func (cache *distributedCache) backgroundContext() (context.Context, context.CancelFunc) {
+	timeout := cache.config.timeout
+	if timeout <= 0 {
+		timeout = backgroundTimeout
+	}
+
+	return context.WithTimeout(cache.ctx, timeout)
+}
+
+// writeContext bounds the copies of a write, by the timeout of the call or like a background request without one
+// Copies still being written once the quorum acknowledged have nobody waiting on them
+func (cache *distributedCache) writeContext(opts callOptions) (context.Context, context.CancelFunc) {
+	if opts.timeout > 0 {
+		return opts.context()
+	}
+
+	return cache.backgroundContext()
+}
+
+// readRepair pushes the authoritative value to the copies that answered without it or with an older or conflicting one
+func (cache *distributedCache) readRepair(key string, newest replicaRead, replies []replicaRead) {
+	for _, read := range replies {
+		held := read.found || read.data.tombstone()
+		if held && read.data.tombstone() == newest.data.tombstone() && read.data.version == newest.data.version && read.data.crc == newest.data.crc {
+			continue
+		}
+
+		logMessage(LOG_DEBUG, "repairing key: "+key+" on "+read.node.ID+" with copy factor "+fmt.Sprintf("%d", read.copy))
+		ctx, cancel := cache.backgroundContext()
+		err := cache.putToNode(ctx, read.node, read.copy, key, newest.data)
+		cancel()
+		if err != nil {
+			logMessage(LOG_ERROR, "failed to repair key: "+key+" on "+read.node.ID)
+			continue
+		}
+
+		cache.stats.readRepairs.Add(1)
+	}
+}
+
+// getFromNode reads a key from a node which might own this cache key, a 404 is an answer without the key
+func (cache *distributedCache) getFromNode(ctx context.Context, cnode *cacheNode, copy int, key string) replicaRead {
+	return cache.readFromNode(ctx, cnode, copy, key, cache.epoch().Digest)
+}
+
+// readFromNode reads a key from a node routing with the given epoch, without epoch it is read from exactly this node
+func (cache *distributedCache) readFromNode(ctx context.Context, cnode *cacheNode, copy int, key string, epoch string) replicaRead {
+	read := replicaRead{node: cnode, copy: copy}
+
+	resp, err := cache.send(ctx, cnode, http.MethodGet, copy, nil, func(target *cacheNode) string {
+		return createURL(target, key, epoch)
+	})
+
+	if err != nil {
 		logMessage(LOG_ERROR, "failed to get key: "+key+" from "+cnode.ID)
-		return []byte{}, fmt.Errorf("failed to get key: %s from %s", key, cnode.ID)
+		read.err = fmt.Errorf("failed to get key: %s from %s", key, cnode.ID)
+		return read
 	}
 
 	defer resp.Body.Close()
-	value, err := io.ReadAll(resp.Body)
 
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		if resp.Header.Get(deletedHeader) != "" {
+			version, _ := strconv.ParseUint(resp.Header.Get(versionHeader), 10, 64)
+			read.data = cacheData{copy: copy, version: version, deleted: time.Now()}
+		}
+		return read
+	default:
+		logMessage(LOG_ERROR, "failed to get key: "+key+" from "+cnode.ID+" status "+resp.Status)
+		read.err = fmt.Errorf("failed to get key: %s from %s: %s", key, cnode.ID, resp.Status)
+		return read
+	}
+
+	value, err := io.ReadAll(resp.Body)
 	if err != nil {
 		logMessage(LOG_ERROR, "failed to read response body: "+err.Error())
-		return []byte{}, fmt.Errorf("failed to read response body: %s", err.Error())
+		read.err = fmt.Errorf("failed to read response body: %s", err.Error())
+		return read
+	}
+
+	version, _ := strconv.ParseUint(resp.Header.Get(versionHeader), 10, 64)
+	crc, _ := strconv.ParseUint(resp.Header.Get(crcHeader), 10, 32)
+
+	read.found = true
+	read.data = cacheData{
+		bytes:   value,
+		copy:    copy,
+		crc:     uint32(crc),
+		version: version,
+	}
+
+	if nanos, _ := strconv.ParseInt(resp.Header.Get(expiresHeader), 10, 64); nanos > 0 {
+		read.data.expires = time.Unix(0, nanos)
 	}
 
-	return value, nil
+	return read
 }
 
 // -----------------------------------------------------------------------
 
-// set sets the value of a key in the distributed cache
-func (cache *distributedCache) set(key string, value []byte) error {
+// set stores the value on the owner (copy 0) and every replica (copy 1..N) in parallel
+// It returns once the write quorum acknowledged, or with an error when that is no longer possible
+func (cache *distributedCache) set(key string, value []byte, opts ...CallOption) error {
+	return cache.setWithTTL(key, value, 0, opts...)
+}
+
+// replicate sends a value or a tombstone to the owners of the key in parallel and waits for the write quorum
+// First acked owners already hold the write, it is sent to the remaining ones only
+// An async write returns once the requests are sent, the copies keep the deadline of the call or the bound of
+// background requests without one
+func (cache *distributedCache) replicate(key string, nodes []*cacheNode, data cacheData, acked int, opts callOptions) error {
+	quorum := min(max(opts.writeQuorum, 1), len(nodes))
+	ctx, cancel := cache.writeContext(opts)
+
+	var wg sync.WaitGroup
+	results := make(chan error, len(nodes))
+	for idx := acked; idx < len(nodes); idx++ {
+		node := nodes[idx]
+		logMessage(LOG_DEBUG, "sending set for key "+key+" to "+node.ID+" with copy factor "+fmt.Sprintf("%d", idx))
+
+		wg.Add(1)
+		go func(cnode *cacheNode, copy int) {
+			defer wg.Done()
+			err := cache.setToNode(ctx, cnode, copy, key, data)
+
+			// Owner could not be reached, keep the write until its heartbeat shows up again
+			var unreachable *url.Error
+			if errors.As(err, &unreachable) {
+				cache.storeHint(cnode, copy, key, data)
+			}
+
+			results <- err
+		}(node, idx)
+	}
 
-	var err error = nil
+	// Copies not needed for the quorum are still being written after the call returns
+	go func() {
+		wg.Wait()
+		cancel()
+	}()
 
-	nodes := cache.hashRing.getNodes(key, cache.redundancy)
-	for idx, node := range nodes {
-		logMessage(LOG_DEBUG, "sending set for key "+key+" to "+node.ID+" with copy factor "+fmt.Sprintf("%d", idx-1))
-		err = cache.setToNode(node, (idx - 1), key, value)
-		if err == nil {
+	if opts.async || (acked > 0 && acked >= quorum) {
+		return nil
+	}
+
+	acks, failures := acked, 0
+	for range nodes[acked:] {
+		if err := <-results; err != nil {
+			failures++
+		} else {
+			acks++
+		}
+
+		if acks >= quorum {
+			return nil
+		}
+
+		if failures > len(nodes)-quorum {
 			break
 		}
-		logMessage(LOG_ERROR, "failed to set key: "+key+" to "+node.ID)
 	}
 
-	return err
+	logMessage(LOG_ERROR, "failed to set key: "+key+", "+fmt.Sprintf("%d of %d", acks, quorum)+" acknowledgements")
+	return fmt.Errorf("%w: key %s acknowledged by %d of %d nodes", ErrWriteQuorum, key, acks, quorum)
 }
 
-// set sets the value of a key in the distributed cache
-func (cache *distributedCache) setToNode(cnode *cacheNode, copy int, key string, value []byte) error {
-	url := createURLForSet(cnode, key, copy)
+// setToNode sends a version of a copy of the key to a node, anything but 200 is a failure
+// The write carries the ring epoch so a node routing with a different ring can redirect it
+func (cache *distributedCache) setToNode(ctx context.Context, cnode *cacheNode, copy int, key string, data cacheData) error {
+	return cache.writeToNode(ctx, cnode, copy, key, data, cache.epoch().Digest)
+}
 
-	kv := map[string][]byte{key: value}
-	data, _ := json.Marshal(kv)
+// putToNode sends a copy to exactly this node without epoch, used when data is moved to a node chosen on purpose
+func (cache *distributedCache) putToNode(ctx context.Context, cnode *cacheNode, copy int, key string, data cacheData) error {
+	return cache.writeToNode(ctx, cnode, copy, key, data, "")
+}
+
+// writeToNode posts a value to a node, or deletes the key there when data is a tombstone
+func (cache *distributedCache) writeToNode(ctx context.Context, cnode *cacheNode, copy int, key string, data cacheData, epoch string) error {
+	method := http.MethodPost
+	var body []byte
+	if data.tombstone() {
+		method = http.MethodDelete
+	} else {
+		body, _ = json.Marshal(map[string][]byte{key: data.bytes})
+	}
+
+	resp, err := cache.send(ctx, cnode, method, copy, body, func(target *cacheNode) string {
+		url := createURLForSet(target, key, copy, data.version, epoch)
+		if !data.expires.IsZero() {
+			url += "&expires=" + strconv.FormatInt(data.expires.UnixNano(), 10)
+		}
+		return url
+	})
 
-	_, err := cache.client.Post(url, "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		logMessage(LOG_ERROR, "failed to set key: "+key+" to "+cnode.ID)
 		return err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logMessage(LOG_ERROR, "failed to set key: "+key+" to "+cnode.ID+" status "+resp.Status)
+		return fmt.Errorf("failed to set key: %s to %s: %s", key, cnode.ID, resp.Status)
+	}
 
 	return nil
 }
 
 // -----------------------------------------------------------------------
 
-// remvoe deletes the entry fromt he hashring
-func (cache *distributedCache) remove(key string) bool {
-	node := cache.hashRing.getNode(key)
-	url := createURL(node, key)
+// ownerWrite is a write only the owner of a key can decide on, a conditional write, an increment or a touch
+type ownerWrite struct {
+	op      string                                      // Name of the write used in logs and errors
+	body    []byte                                      // Request body, nil when the URL carries the whole write
+	url     func(cnode *cacheNode, epoch string) string // URL of the write on a node
+	refused func(status int, current cacheData) error   // Error for a status the owner refuses the write with, nil for other failures
+}
 
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		logMessage(LOG_ERROR, "failed to create request: "+err.Error())
-		return false
+// writeOnOwner sends the write to the owner of the key and replicates what the owner stored like set does
+// Only the owner can check and write under one lock, so the write fails when the owner cannot be reached
+func (cache *distributedCache) writeOnOwner(key string, write ownerWrite, opts callOptions) (cacheData, error) {
+	nodes := cache.hashRing.getNodes(key, cache.redundancy)
+	if len(nodes) == 0 {
+		return cacheData{}, fmt.Errorf("no node owns key %s", key)
 	}
 
-	logMessage(LOG_DEBUG, "sending remove for key "+key+" to "+node.ID)
+	// Owner that never answers must not hold the call forever when it has no timeout
+	ctx, cancel := cache.writeContext(opts)
+	defer cancel()
 
-	// Send the DELETE request
-	resp, err := cache.client.Do(req)
+	data, err := cache.sendToOwner(ctx, nodes[0], key, write)
 	if err != nil {
-		logMessage(LOG_ERROR, "failed to send request: "+err.Error())
-		return false
+		return cacheData{}, err
 	}
 
+	return data, cache.replicate(key, nodes, data, 1, opts)
+}
+
+// sendToOwner sends the write to the owner of the key and returns the value it stored
+func (cache *distributedCache) sendToOwner(ctx context.Context, cnode *cacheNode, key string, write ownerWrite) (cacheData, error) {
+	epoch := cache.epoch().Digest
+	resp, err := cache.send(ctx, cnode, http.MethodPost, 0, write.body, func(target *cacheNode) string {
+		return write.url(target, epoch)
+	})
+
+	if err != nil {
+		logMessage(LOG_ERROR, "failed to "+write.op+" key: "+key+" on "+cnode.ID)
+		return cacheData{}, err
+	}
 	defer resp.Body.Close()
 
-	// Read and print the response body
-	_, err = io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		logMessage(LOG_ERROR, "failed to read response body: "+err.Error())
-		return false
+		return cacheData{}, err
 	}
 
-	return true
+	data := decodeValue(resp, body)
+	if resp.StatusCode == http.StatusOK {
+		return data, nil
+	}
+
+	if err := write.refused(resp.StatusCode, data); err != nil {
+		logMessage(LOG_DEBUG, "cannot "+write.op+" key: "+key+" on "+cnode.ID+": "+err.Error())
+		return cacheData{}, err
+	}
+
+	logMessage(LOG_ERROR, "failed to "+write.op+" key: "+key+" on "+cnode.ID+" status "+resp.Status)
+	return cacheData{}, fmt.Errorf("failed to %s key: %s on %s: %s", write.op, key, cnode.ID, resp.Status)
+}
+
+// decodeValue reads a value sent by writeValue, the version alone when the response carries no value
+func decodeValue(resp *http.Response, body []byte) cacheData {
+	data := cacheData{bytes: body, crc: crc32.ChecksumIEEE(body)}
+	data.version, _ = strconv.ParseUint(resp.Header.Get(versionHeader), 10, 64)
+	if nanos, _ := strconv.ParseInt(resp.Header.Get(expiresHeader), 10, 64); nanos > 0 {
+		data.expires = time.Unix(0, nanos)
+	}
+
+	return data
+}
+
+// -----------------------------------------------------------------------
+
+// remove replaces the key with a tombstone on the owner and every replica
+// It fails like set when fewer owners than the write quorum acknowledged
+func (cache *distributedCache) remove(key string, opts ...CallOption) error {
+	logMessage(LOG_DEBUG, "sending remove for key "+key)
+
+	nodes := cache.hashRing.getNodes(key, cache.redundancy)
+	data := cacheData{version: newVersion(), deleted: time.Now()}
+
+	return cache.replicate(key, nodes, data, 0, cache.config.callOptions(opts...))
 }
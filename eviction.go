@@ -0,0 +1,640 @@
+package vitarit
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// EvictionPolicy names the algorithm a bounded node uses to pick the keys it drops when it runs out of memory
+// Nodes of a group may use different policies, the choice only affects what each node keeps locally
+type EvictionPolicy string
+
+const (
+	EvictLRU     EvictionPolicy = "lru"     // Least recently used key goes first (default)
+	EvictLFU     EvictionPolicy = "lfu"     // Least frequently used key goes first, ties broken by recency
+	EvictARC     EvictionPolicy = "arc"     // Adaptive replacement, balances recency and frequency from ghosts of evicted keys
+	EvictTinyLFU EvictionPolicy = "tinylfu" // Window LRU in front of a segmented LRU, a frequency sketch admits keys into it
+)
+
+// errTooLarge tells a bounded node refused a value which alone takes more than its whole budget
+var errTooLarge = errors.New("value larger than the node memory bound")
+
+// evictionPolicy orders the keys of one copy class of a node, implementations count keys and not bytes
+// Implementations are called with the node lock held
+type evictionPolicy interface {
+	add(key string)        // Key was stored, adding a tracked key counts as a use
+	hit(key string)        // Key was read
+	remove(key string)     // Key was dropped for a reason other than eviction
+	evict() (string, bool) // Picks the key to drop next and stops tracking it
+}
+
+// newEvictionPolicy returns implementation of the named policy, falling back to LRU
+func newEvictionPolicy(policy EvictionPolicy) evictionPolicy {
+	switch policy {
+	case EvictLFU:
+		return newLFUPolicy()
+	case EvictARC:
+		return newARCPolicy()
+	case EvictTinyLFU:
+		return newTinyLFUPolicy()
+	default:
+		return &lruPolicy{keys: newKeyList()}
+	}
+}
+
+// -----------------------------------------------------------------------
+
+// keyList orders keys from the most to the least recently pushed
+type keyList struct {
+	order *list.List               // Keys, most recently pushed at the front
+	items map[string]*list.Element // Maps a key to its place in order
+}
+
+// newKeyList allocates an empty key list
+func newKeyList() *keyList {
+	return &keyList{
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// push moves a key to the front, adding it when it is not in the list
+func (keys *keyList) push(key string) {
+	if elem, found := keys.items[key]; found {
+		keys.order.MoveToFront(elem)
+		return
+	}
+
+	keys.items[key] = keys.order.PushFront(key)
+}
+
+// remove takes a key out of the list and tells whether it was in it
+func (keys *keyList) remove(key string) bool {
+	elem, found := keys.items[key]
+	if found {
+		keys.order.Remove(elem)
+		delete(keys.items, key)
+	}
+
+	return found
+}
+
+// has tells whether a key is in the list
+func (keys *keyList) has(key string) bool {
+	_, found := keys.items[key]
+	return found
+}
+
+// oldest returns the key at the back of the list
+func (keys *keyList) oldest() (string, bool) {
+	elem := keys.order.Back()
+	if elem == nil {
+		return "", false
+	}
+
+	return elem.Value.(string), true
+}
+
+// pop removes and returns the key at the back of the list
+func (keys *keyList) pop() (string, bool) {
+	key, found := keys.oldest()
+	if found {
+		keys.remove(key)
+	}
+
+	return key, found
+}
+
+// len returns number of keys in the list
+func (keys *keyList) len() int {
+	return len(keys.items)
+}
+
+// -----------------------------------------------------------------------
+
+// lruPolicy evicts the key that was used least recently
+type lruPolicy struct {
+	keys *keyList // Keys, most recently used at the front
+}
+
+func (policy *lruPolicy) add(key string) {
+	policy.keys.push(key)
+}
+
+func (policy *lruPolicy) hit(key string) {
+	if policy.keys.has(key) {
+		policy.keys.push(key)
+	}
+}
+
+func (policy *lruPolicy) remove(key string) {
+	policy.keys.remove(key)
+}
+
+func (policy *lruPolicy) evict() (string, bool) {
+	return policy.keys.pop()
+}
+
+// -----------------------------------------------------------------------
+
+// lfuPolicy evicts the key used the fewest times, among those the least recently used
+// Counts never age, a key that was hot long ago stays until it is removed
+type lfuPolicy struct {
+	counts  map[string]int   // Uses of each tracked key
+	buckets map[int]*keyList // Keys by use count, most recently used at the front
+	min     int              // No tracked key has fewer uses, buckets below it are empty
+}
+
+// newLFUPolicy allocates an empty LFU policy
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{
+		counts:  make(map[string]int),
+		buckets: make(map[int]*keyList),
+	}
+}
+
+// move puts a key in the bucket of the given count, dropping the bucket it leaves when empty
+func (policy *lfuPolicy) move(key string, from int, to int) {
+	if bucket, found := policy.buckets[from]; found {
+		bucket.remove(key)
+		if bucket.len() == 0 {
+			delete(policy.buckets, from)
+		}
+	}
+
+	if to == 0 {
+		delete(policy.counts, key)
+		return
+	}
+
+	if policy.buckets[to] == nil {
+		policy.buckets[to] = newKeyList()
+	}
+	policy.buckets[to].push(key)
+	policy.counts[key] = to
+}
+
+func (policy *lfuPolicy) add(key string) {
+	if _, found := policy.counts[key]; found {
+		policy.hit(key)
+		return
+	}
+
+	policy.move(key, 0, 1)
+	policy.min = 1
+}
+
+func (policy *lfuPolicy) hit(key string) {
+	if count, found := policy.counts[key]; found {
+		policy.move(key, count, count+1)
+	}
+}
+
+func (policy *lfuPolicy) remove(key string) {
+	if count, found := policy.counts[key]; found {
+		policy.move(key, count, 0)
+	}
+}
+
+func (policy *lfuPolicy) evict() (string, bool) {
+	if len(policy.counts) == 0 {
+		return "", false
+	}
+
+	// Hits and removes leave min behind, the first bucket at or above it is the lowest one
+	for policy.buckets[policy.min] == nil {
+		policy.min++
+	}
+
+	key, _ := policy.buckets[policy.min].oldest()
+	policy.move(key, policy.min, 0)
+
+	return key, true
+}
+
+// -----------------------------------------------------------------------
+
+// arcPolicy is the adaptive replacement cache of Megiddo and Modha
+// Resident keys seen once and more than once are kept apart, ghosts of the keys evicted from either side
+// tell which side was evicted too early and move the target size of the first one towards it
+// Capacity is the number of resident keys, which changes with the sizes of the values
+type arcPolicy struct {
+	t1     *keyList // Resident keys used once since they were added
+	t2     *keyList // Resident keys used more than once
+	b1     *keyList // Ghosts of keys evicted from t1
+	b2     *keyList // Ghosts of keys evicted from t2
+	target int      // Number of keys t1 should hold, adapted on ghost hits
+}
+
+// newARCPolicy allocates an empty ARC policy
+func newARCPolicy() *arcPolicy {
+	return &arcPolicy{
+		t1: newKeyList(),
+		t2: newKeyList(),
+		b1: newKeyList(),
+		b2: newKeyList(),
+	}
+}
+
+func (policy *arcPolicy) add(key string) {
+	capacity := policy.t1.len() + policy.t2.len() + 1
+
+	switch {
+	case policy.t1.has(key) || policy.t2.has(key):
+		policy.hit(key)
+		return
+
+	case policy.b1.has(key):
+		// Key was evicted from t1 too early, give t1 more room
+		policy.target = min(policy.target+max(policy.b2.len()/policy.b1.len(), 1), capacity)
+		policy.b1.remove(key)
+		policy.t2.push(key)
+
+	case policy.b2.has(key):
+		// Key was evicted from t2 too early, give t2 more room
+		policy.target = max(policy.target-max(policy.b1.len()/policy.b2.len(), 1), 0)
+		policy.b2.remove(key)
+		policy.t2.push(key)
+
+	default:
+		policy.t1.push(key)
+	}
+
+	// Ghosts are bounded like the resident keys, t1 and b1 together hold no more than the capacity
+	for policy.b1.len() > 0 && policy.t1.len()+policy.b1.len() > capacity {
+		policy.b1.pop()
+	}
+	for policy.b2.len() > 0 && policy.t1.len()+policy.t2.len()+policy.b1.len()+policy.b2.len() > 2*capacity {
+		policy.b2.pop()
+	}
+}
+
+func (policy *arcPolicy) hit(key string) {
+	if policy.t1.remove(key) || policy.t2.has(key) {
+		policy.t2.push(key)
+	}
+}
+
+func (policy *arcPolicy) remove(key string) {
+	policy.t1.remove(key)
+	policy.t2.remove(key)
+}
+
+func (policy *arcPolicy) evict() (string, bool) {
+	if policy.t1.len() > 0 && (policy.t1.len() > policy.target || policy.t2.len() == 0) {
+		key, _ := policy.t1.pop()
+		policy.b1.push(key)
+		return key, true
+	}
+
+	key, found := policy.t2.pop()
+	if found {
+		policy.b2.push(key)
+	}
+
+	return key, found
+}
+
+// -----------------------------------------------------------------------
+
+const (
+	tinyLFUWindow    = 0.01    // Share of the keys held by the window LRU
+	tinyLFUProtected = 0.8     // Share of the main keys held by the protected segment
+	sketchWidth      = 1 << 14 // Counters per row of the frequency sketch, a power of two
+	sketchDepth      = 4       // Rows of the frequency sketch, an estimate is the lowest of its counters
+	sketchMaxCount   = 15      // Counters saturate here, like the 4 bit counters of the paper
+)
+
+// frequencySketch is a count-min sketch estimating how often keys were used recently
+// Counters are halved once the sketch saw ten times its width, so old popularity fades
+type frequencySketch struct {
+	rows      [sketchDepth][]uint8 // Counters, one per row is incremented for a key
+	additions int                  // Increments since the last halving
+}
+
+// newFrequencySketch allocates a sketch with every counter at zero
+func newFrequencySketch() *frequencySketch {
+	sketch := &frequencySketch{}
+	for row := range sketch.rows {
+		sketch.rows[row] = make([]uint8, sketchWidth)
+	}
+
+	return sketch
+}
+
+// index returns the counter of a key in a row, rows combine two halves of one hash
+func (sketch *frequencySketch) index(hash uint64, row int) int {
+	h1, h2 := uint32(hash), uint32(hash>>32)|1
+	return int((h1 + uint32(row)*h2) & (sketchWidth - 1))
+}
+
+// increment records a use of the key
+func (sketch *frequencySketch) increment(key string) {
+	hash := XXHash64.Sum64([]byte(key))
+	for row := range sketch.rows {
+		if idx := sketch.index(hash, row); sketch.rows[row][idx] < sketchMaxCount {
+			sketch.rows[row][idx]++
+		}
+	}
+
+	sketch.additions++
+	if sketch.additions >= 10*sketchWidth {
+		for row := range sketch.rows {
+			for idx := range sketch.rows[row] {
+				sketch.rows[row][idx] /= 2
+			}
+		}
+		sketch.additions /= 2
+	}
+}
+
+// estimate returns how often the key was used recently, never less than the real count before saturation
+func (sketch *frequencySketch) estimate(key string) uint8 {
+	hash := XXHash64.Sum64([]byte(key))
+	count := uint8(sketchMaxCount)
+	for row := range sketch.rows {
+		count = min(count, sketch.rows[row][sketch.index(hash, row)])
+	}
+
+	return count
+}
+
+// tinyLFUPolicy is W-TinyLFU of Einziger, Friedman and Manes
+// New keys enter a small window LRU, a key leaving the window competes with the next victim of the main
+// segmented LRU and only the one used more often according to the sketch stays, so a scan cannot flush hot keys
+type tinyLFUPolicy struct {
+	sketch    *frequencySketch // Recent use counts of keys, tracked or not
+	window    *keyList         // Keys added recently, admitted without a frequency check
+	probation *keyList         // Main keys not used since they were admitted
+	protected *keyList         // Main keys used again while on probation
+}
+
+// newTinyLFUPolicy allocates an empty W-TinyLFU policy
+func newTinyLFUPolicy() *tinyLFUPolicy {
+	return &tinyLFUPolicy{
+		sketch:    newFrequencySketch(),
+		window:    newKeyList(),
+		probation: newKeyList(),
+		protected: newKeyList(),
+	}
+}
+
+func (policy *tinyLFUPolicy) add(key string) {
+	if policy.window.has(key) || policy.probation.has(key) || policy.protected.has(key) {
+		policy.hit(key)
+		return
+	}
+
+	policy.sketch.increment(key)
+	policy.window.push(key)
+}
+
+func (policy *tinyLFUPolicy) hit(key string) {
+	policy.sketch.increment(key)
+
+	switch {
+	case policy.window.has(key):
+		policy.window.push(key)
+
+	case policy.probation.remove(key):
+		policy.protected.push(key)
+
+		// Protected keys that no longer fit go back on probation
+		main := policy.probation.len() + policy.protected.len()
+		for policy.protected.len() > int(tinyLFUProtected*float64(main)) {
+			demoted, _ := policy.protected.pop()
+			policy.probation.push(demoted)
+		}
+
+	case policy.protected.has(key):
+		policy.protected.push(key)
+	}
+}
+
+func (policy *tinyLFUPolicy) remove(key string) {
+	policy.window.remove(key)
+	policy.probation.remove(key)
+	policy.protected.remove(key)
+}
+
+func (policy *tinyLFUPolicy) evict() (string, bool) {
+	resident := policy.window.len() + policy.probation.len() + policy.protected.len()
+	windowSize := max(int(tinyLFUWindow*float64(resident)), 1)
+
+	// Window grows freely until the node first runs out of memory, what it holds beyond
+	// its size then fills main without competing, only the last key out of it competes
+	for policy.window.len() > windowSize+1 {
+		key, _ := policy.window.pop()
+		policy.probation.push(key)
+	}
+
+	if policy.window.len() > windowSize {
+		candidate, _ := policy.window.pop()
+
+		victims := policy.probation
+		if victims.len() == 0 {
+			victims = policy.protected
+		}
+
+		victim, found := victims.oldest()
+		if !found || policy.sketch.estimate(candidate) <= policy.sketch.estimate(victim) {
+			return candidate, true
+		}
+
+		victims.remove(victim)
+		policy.probation.push(candidate)
+		return victim, true
+	}
+
+	for _, keys := range []*keyList{policy.probation, policy.protected, policy.window} {
+		if key, found := keys.pop(); found {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// -----------------------------------------------------------------------
+
+// size returns memory accounted to a key and what is stored under it
+func (value cacheData) size(key string) int {
+	return len(key) + len(value.bytes)
+}
+
+// bound limits memory of keys and values held by the node, zero keeps it unbounded
+// Budget is kept for the node as a whole, every shard orders its own keys and gives them up once the node is over
+// Called before the node serves requests, keys already in an attached store are tracked in the order it lists them
+func (cnode *cacheNode) bound(maxBytes int, policy EvictionPolicy) {
+	if maxBytes <= 0 {
+		return
+	}
+
+	cnode.maxBytes = maxBytes
+	for _, sh := range cnode.shards {
+		sh.replicas = newEvictionPolicy(policy)
+		sh.primaries = newEvictionPolicy(policy)
+	}
+
+	// Node is not serving yet, nothing else uses the policies while the stored keys are added
+	tracked := 0
+	cnode.scan(func(key string, value cacheData) bool {
+		if !value.tombstone() {
+			cnode.shardOf(key).policyOf(value.copy).add(key)
+			tracked++
+		}
+		return true
+	})
+
+	// Store may start out over the budget
+	cnode.evict(nil)
+
+	logMessage(LOG_DEBUG, cnode.ID+fmt.Sprintf(" bounded to %d bytes tracking %d stored keys", maxBytes, tracked))
+}
+
+// policyOf returns the policy tracking keys of the given copy, replicas are tracked apart from primaries
+func (sh *shard) policyOf(copy int) evictionPolicy {
+	if copy > 0 {
+		return sh.replicas
+	}
+
+	return sh.primaries
+}
+
+// track tells the policies a key was stored, called with the lock held
+// A value replacing one of the same copy counts as a use of the key, a tombstone is not tracked
+func (sh *shard) track(key string, existing cacheData, found bool, value cacheData) {
+	if found && !existing.tombstone() {
+		if !value.tombstone() && existing.copy == value.copy {
+			sh.policyOf(value.copy).hit(key)
+			return
+		}
+
+		sh.policyOf(existing.copy).remove(key)
+	}
+
+	if !value.tombstone() {
+		sh.policyOf(value.copy).add(key)
+	}
+}
+
+// used records a read served by the node, keys read often or recently are evicted last
+func (cnode *cacheNode) used(key string, hit bool) {
+	if cnode.cache != nil {
+		if hit {
+			cnode.cache.stats.hits.Add(1)
+		} else {
+			cnode.cache.stats.misses.Add(1)
+		}
+	}
+
+	if !hit || cnode.maxBytes == 0 {
+		return
+	}
+
+	sh := cnode.shardOf(key)
+
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	if value, found := sh.get(key); found && !value.tombstone() {
+		sh.policyOf(value.copy).hit(key)
+	}
+}
+
+// over tells whether the node holds more than its budget
+func (cnode *cacheNode) over() bool {
+	return cnode.bytes.Load() > int64(cnode.maxBytes)
+}
+
+// evict drops keys picked by the policies until the node is within its budget, called with the lock of home held
+// Replicas of every shard go before any primary since another node still holds the primary, shards give up a key
+// in turn from the one after home. Home only gives up one once no other shard has any left, so a value just written
+// stays while the node holds anything else. A shard locked by someone else is skipped, when that is all that keeps
+// the node over budget the next write evicts again
+func (cnode *cacheNode) evict(home *shard) {
+	start := slices.Index(cnode.shards, home) + 1
+
+	for _, replicas := range []bool{true, false} {
+		for cnode.over() {
+			evicted, busy := false, false
+			for i := range cnode.shards {
+				sh := cnode.shards[(start+i)%len(cnode.shards)]
+				if sh == home || !cnode.over() {
+					continue
+				}
+
+				if !sh.mtx.TryLock() {
+					busy = true
+					continue
+				}
+				evicted = sh.evictOne(replicas) || evicted
+				sh.mtx.Unlock()
+			}
+
+			if busy && !evicted {
+				return
+			}
+
+			if !evicted && (home == nil || !home.evictOne(replicas)) {
+				break
+			}
+		}
+	}
+}
+
+// evictOne drops the replica or primary the policy of the shard picks, called with the lock held
+// Tombstones are never tracked so a remove is not undone, returns false when the policy tracks no key
+func (sh *shard) evictOne(replicas bool) bool {
+	policy := sh.primaries
+	if replicas {
+		policy = sh.replicas
+	}
+
+	key, found := policy.evict()
+	if !found {
+		return false
+	}
+
+	value, _ := sh.release(key)
+	logMessage(LOG_DEBUG, sh.node.ID+" evicted key: "+key+fmt.Sprintf(" of %d bytes", value.size(key)))
+
+	if sh.node.cache != nil {
+		sh.node.cache.stats.evictions.Add(1)
+		sh.node.cache.stats.evictedBytes.Add(uint64(value.size(key)))
+	}
+
+	return true
+}
+
+// -----------------------------------------------------------------------
+
+// HitRatio replays reads of the given keys against a node bounded to maxBytes that evicts with the policy
+// A read that misses writes the key with a value of valueSize bytes, as a cache-aside client would
+// Replaying the same trace with each policy compares them on one workload
+func HitRatio(policy EvictionPolicy, maxBytes int, valueSize int, trace []string) float64 {
+	if len(trace) == 0 {
+		return 0
+	}
+
+	// Single shard so one policy orders every key
+	cnode := newCacheNode(nodeInfo{ID: "hit-ratio-" + string(policy)})
+	cnode.split(1)
+	cnode.bound(maxBytes, policy)
+
+	value := make([]byte, valueSize)
+	hits := 0
+	for i, key := range trace {
+		if _, found := cnode.get(key); found {
+			cnode.used(key, true)
+			hits++
+			continue
+		}
+
+		cnode.set(key, 0, value, uint64(i+1))
+	}
+
+	return float64(hits) / float64(len(trace))
+}
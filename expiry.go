@@ -0,0 +1,189 @@
+package vitarit
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	sweepInterval = time.Second // Time between two rounds of the expiry sweeper
+	sweepBatch    = 128         // Keys sampled per batch, the node lock is released between batches
+	sweepRounds   = 16          // Batches run per round at most, even if many sampled keys were expired
+)
+
+// ErrNotFound is returned when a key to touch does not exist on its owner
+var ErrNotFound = errors.New("key not found")
+
+// -----------------------------------------------------------------------
+
+// sweep samples up to batch keys which carry an expiry and drops the expired ones
+// Batch is spread over the shards, a shard is locked only while its part is sampled
+// Map iteration starts at a random key, so successive batches look at different keys
+func (cnode *cacheNode) sweep(now time.Time, batch int) (sampled int, expired int) {
+	perShard := max(batch/len(cnode.shards), 1)
+
+	for _, sh := range cnode.shards {
+		sh.mtx.Lock()
+		taken := 0
+		for key, expires := range sh.expiries {
+			if taken == perShard {
+				break
+			}
+			taken++
+
+			if !now.Before(expires) {
+				sh.drop(key)
+				expired++
+			}
+		}
+		sh.mtx.Unlock()
+
+		sampled += taken
+	}
+
+	return sampled, expired
+}
+
+// touch sets a new expiry on a key, zero ttl makes it never expire
+// It gets a version newer than the one it replaces so replicas take the new expiry
+func (cnode *cacheNode) touch(key string, copy int, ttl time.Duration) (cacheData, bool, error) {
+	sh := cnode.shardOf(key)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+
+	now := time.Now()
+	value, live := sh.live(key, now)
+	if !live {
+		return cacheData{}, false, nil
+	}
+
+	value.copy = copy
+	value.version = max(newVersion(), value.version+1)
+	value.expires = time.Time{}
+	if ttl > 0 {
+		value.expires = now.Add(ttl)
+	}
+	if err := sh.store(key, value); err != nil {
+		return value, true, err
+	}
+
+	logMessage(LOG_DEBUG, cnode.ID+" touched key: "+key+" ttl "+ttl.String())
+	return value, true, nil
+}
+
+// serveTouch answers a touch with the value in the body along with its new version and expiry
+func (cnode *cacheNode) serveTouch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	copy, _ := strconv.Atoi(query.Get("copy"))
+
+	ttl, err := strconv.ParseInt(query.Get("touch"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logMessage(LOG_DEBUG, cnode.ID+" received touch key: "+key)
+
+	data, found, err := cnode.touch(key, copy, time.Duration(ttl))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeValue(w, data)
+}
+
+// -----------------------------------------------------------------------
+
+// runSweeper reclaims expired keys of the local node until the cache stops
+// A round keeps sampling while more than a quarter of the sampled keys were expired
+func (cache *distributedCache) runSweeper() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cache.ctx.Done():
+			return
+		case <-ticker.C:
+			cache.sweep(time.Now())
+		}
+	}
+}
+
+// sweep runs one round of the sweeper and returns how many keys it reclaimed
+func (cache *distributedCache) sweep(now time.Time) int {
+	reclaimed := 0
+	for round := 0; round < sweepRounds; round++ {
+		sampled, expired := cache.local.sweep(now, sweepBatch)
+		reclaimed += expired
+
+		if sampled == 0 || expired*4 <= sampled {
+			break
+		}
+	}
+
+	if reclaimed > 0 {
+		logMessage(LOG_DEBUG, fmt.Sprintf("sweeper reclaimed %d expired keys", reclaimed))
+		cache.stats.expired.Add(uint64(reclaimed))
+	}
+
+	return reclaimed
+}
+
+// setWithTTL stores a value which expires after ttl on every copy, zero ttl never expires
+func (cache *distributedCache) setWithTTL(key string, value []byte, ttl time.Duration, opts ...CallOption) error {
+	nodes := cache.hashRing.getNodes(key, cache.redundancy)
+	data := cacheData{bytes: value, crc: crc32.ChecksumIEEE(value), version: newVersion()}
+	if ttl > 0 {
+		data.expires = time.Now().Add(ttl)
+	}
+
+	return cache.replicate(key, nodes, data, 0, cache.config.callOptions(opts...))
+}
+
+// ttl returns time left before a key expires, zero when it never does
+func (cache *distributedCache) ttl(key string, opts ...CallOption) (time.Duration, bool) {
+	data, found := cache.read(key, opts...)
+	if !found {
+		return 0, false
+	}
+
+	if data.expires.IsZero() {
+		return 0, true
+	}
+
+	return max(time.Until(data.expires), time.Nanosecond), true
+}
+
+// createURLForTouch creates a URL to change the expiry of a key on its owner
+func createURLForTouch(cnode *cacheNode, key string, ttl time.Duration, epoch string) string {
+	return fmt.Sprintf("https://%s:%s?id=%s&key=%s&copy=0&touch=%d&epoch=%s", cnode.IP, cnode.Port, cnode.ID, url.QueryEscape(key), int64(ttl), epoch)
+}
+
+// touch changes the expiry of a key on its owner, which decides whether the key still exists, and replicates the key
+func (cache *distributedCache) touch(key string, ttl time.Duration, opts ...CallOption) error {
+	_, err := cache.writeOnOwner(key, ownerWrite{
+		op: "touch",
+		url: func(cnode *cacheNode, epoch string) string {
+			return createURLForTouch(cnode, key, ttl, epoch)
+		},
+		refused: func(status int, _ cacheData) error {
+			if status == http.StatusNotFound {
+				return fmt.Errorf("%w: %s", ErrNotFound, key)
+			}
+			return nil
+		},
+	}, cache.config.callOptions(opts...))
+
+	return err
+}
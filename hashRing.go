@@ -1,43 +1,95 @@
 package vitarit
 
 import (
-	"hash/crc32"
+	"fmt"
+	"maps"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
-// hashRing is a consistent hash ring that uses the CRC32 algorithm
+// hashRing is a consistent hash ring that places nodes and keys using a pluggable hasher
 type hashRing struct {
-	nodes        []*cacheNode          // List of nodes participating in the ring
-	sortedHashes []uint32              // Sorted list of hashes
-	nodeMap      map[uint32]*cacheNode // Maps hash to node
+	nodes        []*cacheNode          // List of nodes participating in the ring, sorted by ID
+	sortedHashes []uint64              // Sorted list of hashes
+	nodeMap      map[uint64]*cacheNode // Maps hash of a virtual node to its physical node
+	idMap        map[string]*cacheNode // Maps node ID to node
+	vnodes       map[string][]uint64   // Maps node ID to the hashes of its virtual nodes
+	virtualNodes int                   // Virtual nodes placed per unit of node weight
+	hasher       Hasher                // Hash function used for node and key positions
+	strategy     placementStrategy     // Algorithm choosing owners of a key
+	loadFactor   float64               // Bounded load capacity factor, 0 disables bounded loads
+	shares       map[string]int        // Slots out of keepSlots each full node keeps its keys in, empty when no node is full
+	hashTags     bool                  // Hash only the {tag} part of keys so related keys share owners
+	version      uint64                // Membership epoch, incremented on every join or leave
+	digest       string                // Digest of the member IDs and shares of full nodes, equal on nodes that see the same ring
 	mtx          sync.Mutex            // Lock to protect the ring
 }
 
+// keepSlots is the resolution of the share of its keys a full node keeps
+// Demand drifting with every write only moves keys once a node crosses a whole slot
+const keepSlots = 64
+
 // -----------------------------------------------------------------------
 
 // NewHashRing allocates a new hash ring
-func NewHashRing() *hashRing {
+func NewHashRing(cfg config) *hashRing {
 	logMessage(LOG_DEBUG, "creating new hash ring")
 
+	if cfg.virtualNodes <= 0 {
+		cfg.virtualNodes = defaultVirtualNodes
+	}
+
+	if cfg.hasher == nil {
+		cfg.hasher = CRC32Hasher
+	}
+
 	return &hashRing{
-		nodeMap: make(map[uint32]*cacheNode),
+		nodeMap:      make(map[uint64]*cacheNode),
+		idMap:        make(map[string]*cacheNode),
+		vnodes:       make(map[string][]uint64),
+		virtualNodes: cfg.virtualNodes,
+		hasher:       cfg.hasher,
+		strategy:     newPlacementStrategy(cfg.placement),
+		loadFactor:   cfg.loadFactor,
+		hashTags:     cfg.hashTags,
+		shares:       map[string]int{},
+		digest:       membershipDigest(nil, nil),
+	}
+}
+
+// -----------------------------------------------------------------------
+
+// vnodeName returns the name hashed to place the i'th virtual node of a node on the ring
+// First virtual node uses the bare ID so a ring with one vnode per node matches the old layout
+func vnodeName(nodeID string, i int) string {
+	if i == 0 {
+		return nodeID
+	}
+
+	return nodeID + "#" + strconv.Itoa(i)
+}
+
+// vnodeCount returns number of virtual nodes a node gets based on its advertised weight
+func (ring *hashRing) vnodeCount(node nodeInfo) int {
+	weight := node.Weight
+	if weight <= 0 {
+		weight = 1
 	}
+
+	return ring.virtualNodes * weight
 }
 
 // -----------------------------------------------------------------------
 
 // addNode adds a new node to the hash ring
 func (ring *hashRing) addNode(node nodeInfo) {
-	hash := crc32.ChecksumIEEE([]byte(node.ID))
-
 	ring.mtx.Lock()
 	defer ring.mtx.Unlock()
 
-	_, found := ring.nodeMap[hash]
-	if found {
-		// This is just a heartbeat from an existing node
-		// No need to update any data structures here just mark that node is alive
+	if _, found := ring.idMap[node.ID]; found {
+		// This is just a heartbeat from an existing node, its load is refreshed through setLoad
 		logMessage(LOG_DEBUG, "HB received from "+node.ID)
 		return
 	}
@@ -45,24 +97,43 @@ func (ring *hashRing) addNode(node nodeInfo) {
 	// New node found so lets create it and add it to our consistent hash ring
 	cnode := newCacheNode(node)
 
-	logMessage(LOG_DEBUG, "hashring adding a new node "+cnode.ID)
+	logMessage(LOG_DEBUG, "hashring adding a new node "+cnode.ID+" with "+strconv.Itoa(ring.vnodeCount(node))+" virtual nodes")
 	ring.nodes = append(ring.nodes, cnode)
-	ring.sortedHashes = append(ring.sortedHashes, hash)
-	ring.nodeMap[hash] = cnode
+	ring.idMap[node.ID] = cnode
+
+	// Stable order by ID is what jump placement numbers its buckets by
+	sort.Slice(ring.nodes, func(i, j int) bool {
+		return ring.nodes[i].ID < ring.nodes[j].ID
+	})
+
+	hashes := make([]uint64, 0, ring.vnodeCount(node))
+	for i := 0; i < ring.vnodeCount(node); i++ {
+		hash := ring.hasher.Sum64([]byte(vnodeName(node.ID, i)))
+		if owner, collide := ring.nodeMap[hash]; collide {
+			// Two virtual nodes landed on the same point, first one keeps it
+			logMessage(LOG_WARNING, "hashring vnode "+vnodeName(node.ID, i)+" collides with "+owner.ID+", skipping")
+			continue
+		}
+
+		hashes = append(hashes, hash)
+		ring.sortedHashes = append(ring.sortedHashes, hash)
+		ring.nodeMap[hash] = cnode
+	}
+	ring.vnodes[node.ID] = hashes
 
 	sort.Slice(ring.sortedHashes, func(i, j int) bool {
 		return ring.sortedHashes[i] < ring.sortedHashes[j]
 	})
+
+	ring.bumpEpoch()
 }
 
 // removeNode removes a node from the hash ring
 func (ring *hashRing) removeNode(nodeID string) {
-	hash := crc32.ChecksumIEEE([]byte(nodeID))
-
 	ring.mtx.Lock()
 	defer ring.mtx.Unlock()
 
-	_, found := ring.nodeMap[hash]
+	_, found := ring.idMap[nodeID]
 	if !found {
 		// This node is not found in the ring
 		logMessage(LOG_DEBUG, "hashring not able to remove "+nodeID)
@@ -70,14 +141,20 @@ func (ring *hashRing) removeNode(nodeID string) {
 	}
 
 	logMessage(LOG_DEBUG, "hashring removing "+nodeID)
-	delete(ring.nodeMap, hash)
-
-	for i, h := range ring.sortedHashes {
-		if h == hash {
-			ring.sortedHashes = append(ring.sortedHashes[:i], ring.sortedHashes[i+1:]...)
-			break
+	for _, hash := range ring.vnodes[nodeID] {
+		delete(ring.nodeMap, hash)
+	}
+	delete(ring.vnodes, nodeID)
+	delete(ring.idMap, nodeID)
+
+	// Filter in place, remaining hashes are still sorted
+	hashes := ring.sortedHashes[:0]
+	for _, h := range ring.sortedHashes {
+		if _, found := ring.nodeMap[h]; found {
+			hashes = append(hashes, h)
 		}
 	}
+	ring.sortedHashes = hashes
 
 	for i, node := range ring.nodes {
 		if node.ID == nodeID {
@@ -85,31 +162,313 @@ func (ring *hashRing) removeNode(nodeID string) {
 			break
 		}
 	}
+
+	ring.bumpEpoch()
+}
+
+// -----------------------------------------------------------------------
+
+// membershipDigest hashes the sorted member IDs, nodes seeing the same members get the same digest
+// Shares kept by nodes above the bounded load limit are hashed as well, as the rest of their keys overflow
+func membershipDigest(nodes []*cacheNode, shares map[string]int) string {
+	ids := make([]string, 0, len(nodes))
+	for _, cnode := range nodes {
+		ids = append(ids, cnode.ID)
+	}
+
+	members := strings.Join(ids, "\n")
+	if len(shares) > 0 {
+		full := make([]string, 0, len(shares))
+		for _, id := range ids {
+			if share, found := shares[id]; found {
+				full = append(full, id+"="+strconv.Itoa(share))
+			}
+		}
+		members += "\nfull:" + strings.Join(full, ",")
+	}
+
+	return fmt.Sprintf("%016x", FNV1a64Hasher.Sum64([]byte(members)))
+}
+
+// bumpEpoch moves the ring to a new epoch after a membership change, caller shall hold the ring lock
+func (ring *hashRing) bumpEpoch() {
+	ring.version++
+	ring.shares = ring.fullShares()
+	ring.digest = membershipDigest(ring.nodes, ring.shares)
+	logMessage(LOG_DEBUG, "hashring moved to epoch "+strconv.FormatUint(ring.version, 10)+" digest "+ring.digest)
+}
+
+// epoch returns current membership epoch of the ring
+func (ring *hashRing) epoch() Epoch {
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	return Epoch{
+		Version: ring.version,
+		Digest:  ring.digest,
+		Members: len(ring.nodes),
+	}
 }
 
 // -----------------------------------------------------------------------
 
 // getNodeByID returns the node with the given ID
 func (ring *hashRing) getNodeByID(id string) *cacheNode {
-	hash := crc32.ChecksumIEEE([]byte(id))
-
 	ring.mtx.Lock()
 	defer ring.mtx.Unlock()
 
 	logMessage(LOG_DEBUG, "hashring searching node for id "+id)
 
-	return ring.nodeMap[hash]
+	return ring.idMap[id]
 }
 
-// getNode returns the node that a key belongs to
-func (ring *hashRing) getNode(key string) *cacheNode {
-	hash := crc32.ChecksumIEEE([]byte(key))
+// members returns information of all nodes participating in the ring
+func (ring *hashRing) members() []nodeInfo {
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	peers := make([]nodeInfo, 0, len(ring.nodes))
+	for _, node := range ring.nodes {
+		peers = append(peers, node.nodeInfo)
+	}
+
+	return peers
+}
 
+// setLoad records the keys a node advertised in its heartbeat, those it owns and how many of them overflowed from full nodes
+// With bounded loads a node becoming full or keeping another share of its keys moves keys, so the ring then moves to a new epoch
+func (ring *hashRing) setLoad(id string, load int, overflow map[string]int) {
 	ring.mtx.Lock()
 	defer ring.mtx.Unlock()
 
-	logMessage(LOG_DEBUG, "hashring searching node for key "+key)
+	cnode, found := ring.idMap[id]
+	if !found {
+		return
+	}
+
+	cnode.Load = load
+	cnode.Overflow = overflow
+
+	if !maps.Equal(ring.shares, ring.fullShares()) {
+		ring.bumpEpoch()
+	}
+}
+
+// overflows tells whether the given load of a node changes the shares full nodes keep, and with that the owners of keys
+func (ring *hashRing) overflows(id string, load int, overflow map[string]int) bool {
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	cnode, found := ring.idMap[id]
+	if !found || (cnode.Load == load && maps.Equal(cnode.Overflow, overflow)) {
+		return false
+	}
+
+	oldLoad, oldOverflow := cnode.Load, cnode.Overflow
+	cnode.Load, cnode.Overflow = load, overflow
+	changed := !maps.Equal(ring.shares, ring.fullShares())
+	cnode.Load, cnode.Overflow = oldLoad, oldOverflow
+
+	return changed
+}
+
+// demand returns number of keys each node would own if no node was full, caller shall hold the ring lock
+// Keys a node owns on behalf of a full node count for that node, so demand does not change as keys overflow
+// and a full node does not look empty once its keys moved away
+func (ring *hashRing) demand() map[string]int {
+	demand := make(map[string]int, len(ring.nodes))
+	for _, cnode := range ring.nodes {
+		demand[cnode.ID] += cnode.Load
+
+		for id, count := range cnode.Overflow {
+			if _, member := ring.idMap[id]; member {
+				demand[cnode.ID] -= count
+				demand[id] += count
+			}
+		}
+	}
+
+	return demand
+}
+
+// fullShares returns the slots out of keepSlots each node above the load limit keeps its keys in, caller shall hold the ring lock
+// Limit is (1+e) times the average demand, a full node keeps about as many keys as the limit and only the rest overflows
+func (ring *hashRing) fullShares() map[string]int {
+	shares := map[string]int{}
+	if ring.loadFactor <= 0 || len(ring.nodes) == 0 {
+		return shares
+	}
+
+	demand := ring.demand()
+	total := 0
+	for _, keys := range demand {
+		total += keys
+	}
+
+	limit := (1 + ring.loadFactor) * float64(total) / float64(len(ring.nodes))
+	for id, keys := range demand {
+		if float64(keys) > limit {
+			shares[id] = max(int(limit*keepSlots/float64(keys)), 1)
+		}
+	}
+
+	return shares
+}
+
+// keepSlot places a key in one of keepSlots slots, a full node keeps the keys in the slots below its share
+func keepSlot(key string) int {
+	return int(FNV1a64Hasher.Sum64([]byte(key)) % keepSlots)
+}
 
+// ownedLoad counts the keys a node owns, those which belong to another node without bounded loads overflowed from it
+// and are counted per that node as well, so peers can work out its demand
+// Keys are placed on a snapshot of the ring, lookups are not held up while every local key is scored
+func (ring *hashRing) ownedLoad(nodeID string, keys []string) (int, map[string]int) {
+	snap := ring.snapshot()
+
+	var overflow map[string]int
+	for _, key := range keys {
+		if snap.hashTags {
+			key = hashTag(key)
+		}
+
+		nodes := snap.strategy.pick(snap, key, 1)
+		if len(nodes) == 0 || nodes[0].ID == nodeID {
+			continue
+		}
+
+		if overflow == nil {
+			overflow = make(map[string]int)
+		}
+		overflow[nodes[0].ID]++
+	}
+
+	return len(keys), overflow
+}
+
+// hashTag returns the part of the key inside the first {...}, or the whole key when there is no non-empty tag
+// order:{42}:items and order:{42}:status both hash as 42 and land on the same nodes
+func hashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+
+	return key[start+1 : start+1+end]
+}
+
+// owners returns count distinct nodes for a key, caller shall hold the ring lock
+// With bounded loads a full node is skipped and the key overflows to the next preferred node
+// With zone or rack labels the replicas are spread over distinct failure domains first
+func (ring *hashRing) owners(key string, count int) []*cacheNode {
+	if ring.hashTags {
+		key = hashTag(key)
+	}
+
+	bounded := len(ring.shares) > 0
+	zoned := ring.hasDomains()
+
+	if (!bounded && !zoned) || len(ring.nodes) == 0 {
+		return ring.strategy.pick(ring, key, count)
+	}
+
+	nodes := ring.strategy.pick(ring, key, len(ring.nodes))
+	if bounded {
+		nodes = ring.boundLoad(key, nodes)
+	}
+
+	if zoned {
+		return spreadDomains(nodes, count)
+	}
+
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+
+	return nodes
+}
+
+// boundLoad moves full nodes behind the others, keeping preference order within both groups
+// A full node stays in front only for its own keys in the share it keeps, it takes no keys overflowing from another node
+func (ring *hashRing) boundLoad(key string, prefs []*cacheNode) []*cacheNode {
+	slot := keepSlot(key)
+	nodes := make([]*cacheNode, 0, len(prefs))
+	full := []*cacheNode{}
+
+	for idx, cnode := range prefs {
+		if share, found := ring.shares[cnode.ID]; found && (idx > 0 || slot >= share) {
+			logMessage(LOG_DEBUG, "hashring skipping full node "+cnode.ID+" for key "+key)
+			full = append(full, cnode)
+			continue
+		}
+
+		nodes = append(nodes, cnode)
+	}
+
+	// Full nodes remain last resort when there are fewer other nodes than copies
+	return append(nodes, full...)
+}
+
+// hasDomains tells whether any node advertised a zone or rack label
+func (ring *hashRing) hasDomains() bool {
+	for _, cnode := range ring.nodes {
+		if cnode.Zone != "" || cnode.Rack != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// spreadDomains picks count nodes from the preference list, the first preferred node stays the owner
+// Replicas go to unused zones first, then to unused racks, and only then reuse a failure domain
+func spreadDomains(prefs []*cacheNode, count int) []*cacheNode {
+	nodes := make([]*cacheNode, 0, count)
+	if len(prefs) == 0 || count <= 0 {
+		return nodes
+	}
+
+	picked := make(map[string]bool)
+	zones := make(map[string]bool)
+	racks := make(map[string]bool)
+
+	take := func(cnode *cacheNode) {
+		nodes = append(nodes, cnode)
+		picked[cnode.ID] = true
+		zones[cnode.Zone] = true
+		racks[cnode.Zone+"/"+cnode.Rack] = true
+	}
+
+	take(prefs[0])
+
+	passes := []func(*cacheNode) bool{
+		func(cnode *cacheNode) bool { return !zones[cnode.Zone] },
+		func(cnode *cacheNode) bool { return !racks[cnode.Zone+"/"+cnode.Rack] },
+		func(cnode *cacheNode) bool { return true },
+	}
+
+	for _, eligible := range passes {
+		for _, cnode := range prefs {
+			if len(nodes) == count {
+				return nodes
+			}
+
+			if !picked[cnode.ID] && eligible(cnode) {
+				take(cnode)
+			}
+		}
+	}
+
+	return nodes
+}
+
+// search returns index of the first virtual node at or after the given hash, wrapping around the ring
+func (ring *hashRing) search(hash uint64) int {
 	idx := sort.Search(len(ring.sortedHashes), func(i int) bool {
 		return ring.sortedHashes[i] >= hash
 	})
@@ -118,46 +477,76 @@ func (ring *hashRing) getNode(key string) *cacheNode {
 		idx = 0
 	}
 
-	return ring.nodeMap[ring.sortedHashes[idx]]
+	return idx
+}
+
+// getNode returns the node that a key belongs to
+func (ring *hashRing) getNode(key string) *cacheNode {
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	logMessage(LOG_DEBUG, "hashring searching node for key "+key)
+
+	nodes := ring.owners(key, 1)
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	return nodes[0]
 }
 
 // -----------------------------------------------------------------------
 
-// getNode returns the node that a key belongs to
+// getNodes returns the node that a key belongs to followed by distinct physical nodes holding its redundant copies
 func (ring *hashRing) getNodes(key string, redundancy int) []*cacheNode {
-	nodes := []*cacheNode{}
-	hash := crc32.ChecksumIEEE([]byte(key))
-
 	ring.mtx.Lock()
 	defer ring.mtx.Unlock()
 
 	logMessage(LOG_DEBUG, "hashring searching node for key "+key)
 
-	idx := sort.Search(len(ring.sortedHashes), func(i int) bool {
-		return ring.sortedHashes[i] >= hash
-	})
+	return ring.owners(key, redundancy+1)
+}
 
-	// Normalise index of the node where the key belongs
-	if idx == len(ring.sortedHashes) {
-		idx = 0
+// locate returns information of the nodes a key belongs to, owner first
+func (ring *hashRing) locate(key string, redundancy int) []nodeInfo {
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	nodes := ring.owners(key, redundancy+1)
+
+	placement := make([]nodeInfo, 0, len(nodes))
+	for _, cnode := range nodes {
+		placement = append(placement, cnode.nodeInfo)
 	}
 
-	masterIdx := idx
-	nodes = append(nodes, ring.nodeMap[ring.sortedHashes[idx]])
+	return placement
+}
 
-	for redundancy > 0 {
-		idx++
-		if idx >= len(ring.sortedHashes) {
-			idx = 0
-		}
+// ringInfo returns ring positions of every node and the fraction of the hash space it owns
+func (ring *hashRing) ringInfo() []NodeRingInfo {
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
 
-		if idx == masterIdx {
-			break
+	owned := ring.strategy.ownership(ring)
+	_, walk := ring.strategy.(ringPlacement)
+
+	info := make([]NodeRingInfo, 0, len(ring.nodes))
+	for _, cnode := range ring.nodes {
+		// Virtual nodes only decide ownership when keys are placed by walking the ring
+		positions := []uint64{}
+		if walk {
+			positions = append(positions, ring.vnodes[cnode.ID]...)
+			sort.Slice(positions, func(i, j int) bool {
+				return positions[i] < positions[j]
+			})
 		}
 
-		nodes = append(nodes, ring.nodeMap[ring.sortedHashes[idx]])
-		redundancy--
+		info = append(info, NodeRingInfo{
+			Node:      cnode.nodeInfo,
+			Positions: positions,
+			Ownership: owned[cnode.ID],
+		})
 	}
 
-	return nodes
+	return info
 }
@@ -0,0 +1,152 @@
+package vitarit
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"math/bits"
+)
+
+// Hasher maps a node or key name to a 64 bit position on the ring
+// All nodes of a group must use the same hasher, its name is advertised in heartbeats
+type Hasher interface {
+	Name() string             // Identity of the hash function carried in heartbeats
+	Sum64(data []byte) uint64 // Position of the data on the ring
+}
+
+// Built in hashers which can be passed to WithHasher
+var (
+	CRC32Hasher   Hasher = crc32Hasher{}   // Default, compatible with nodes that do not advertise a hasher
+	FNV1a64Hasher Hasher = fnv1a64Hasher{} // FNV-1a 64 bit from the standard library
+	XXHash64      Hasher = xxHash64{}      // xxHash64 with seed 0, best avalanche for short similar keys
+)
+
+// hashSpace is implemented by hashers whose output does not cover all 64 bits
+type hashSpace interface {
+	bits() uint
+}
+
+// hashSpaceBits returns width of the positions produced by a hasher
+func hashSpaceBits(hasher Hasher) uint {
+	if space, ok := hasher.(hashSpace); ok {
+		return space.bits()
+	}
+
+	return 64
+}
+
+// defaultHasherName is assumed for peers whose heartbeat does not carry a hasher
+const defaultHasherName = "crc32"
+
+// -----------------------------------------------------------------------
+
+type crc32Hasher struct{}
+
+func (crc32Hasher) Name() string {
+	return defaultHasherName
+}
+
+func (crc32Hasher) Sum64(data []byte) uint64 {
+	return uint64(crc32.ChecksumIEEE(data))
+}
+
+func (crc32Hasher) bits() uint {
+	return 32
+}
+
+// -----------------------------------------------------------------------
+
+type fnv1a64Hasher struct{}
+
+func (fnv1a64Hasher) Name() string {
+	return "fnv1a64"
+}
+
+func (fnv1a64Hasher) Sum64(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// -----------------------------------------------------------------------
+
+// xxHash64 is a pure Go implementation of the 64 bit xxHash algorithm
+type xxHash64 struct{}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func (xxHash64) Name() string {
+	return "xxhash64"
+}
+
+func (xxHash64) Sum64(b []byte) uint64 {
+	var seed, h uint64
+	n := len(b)
+
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+			b = b[32:]
+		}
+
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b[:8]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b[:4])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+
+	for ; len(b) > 0; b = b[1:] {
+		h ^= uint64(b[0]) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	// Final avalanche
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
@@ -0,0 +1,189 @@
+package vitarit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHintBytes = 16 << 20         // Memory held by hints for unreachable nodes
+	defaultHintTTL   = 10 * time.Minute // Hints older than this are dropped
+)
+
+// hint is a write that could not be delivered to one of the owners of a key
+type hint struct {
+	key     string    // Key that was written
+	data    cacheData // Value and version of the write, a tombstone when the key was removed
+	copy    int       // Copy of the key the target node holds
+	expires time.Time // After this the hint is dropped
+}
+
+// hintStore keeps undelivered writes per target node until the node is seen again
+type hintStore struct {
+	hints     map[string][]hint // Maps target node ID to its pending hints, oldest first
+	replaying map[string]bool   // Nodes whose hints are being replayed right now
+	bytes     int               // Memory accounted to all hints
+	maxBytes  int               // Hints are refused beyond this size
+	ttl       time.Duration     // Lifetime of a hint
+	mtx       sync.Mutex        // Lock to protect the hints
+}
+
+// -----------------------------------------------------------------------
+
+// newHintStore allocates a store bounded to maxBytes whose hints live for ttl
+func newHintStore(maxBytes int, ttl time.Duration) *hintStore {
+	return &hintStore{
+		hints:     make(map[string][]hint),
+		replaying: make(map[string]bool),
+		maxBytes:  maxBytes,
+		ttl:       ttl,
+	}
+}
+
+// size returns memory accounted to a hint
+func (h *hint) size() int {
+	return len(h.key) + len(h.data.bytes)
+}
+
+// add stores a hint for the target node, returns false when the store is full
+func (store *hintStore) add(nodeID string, key string, data cacheData, copy int) bool {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	h := hint{
+		key:     key,
+		data:    data,
+		copy:    copy,
+		expires: time.Now().Add(store.ttl),
+	}
+
+	if store.bytes+h.size() > store.maxBytes {
+		return false
+	}
+
+	store.hints[nodeID] = append(store.hints[nodeID], h)
+	store.bytes += h.size()
+
+	return true
+}
+
+// take removes and returns the live hints for a node, unless they are already being replayed
+func (store *hintStore) take(nodeID string) []hint {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if store.replaying[nodeID] || len(store.hints[nodeID]) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	live := []hint{}
+	for _, h := range store.hints[nodeID] {
+		store.bytes -= h.size()
+		if now.Before(h.expires) {
+			live = append(live, h)
+		}
+	}
+
+	delete(store.hints, nodeID)
+	store.replaying[nodeID] = true
+
+	return live
+}
+
+// done ends a replay, hints that could not be delivered go back to the store
+func (store *hintStore) done(nodeID string, failed []hint) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	delete(store.replaying, nodeID)
+
+	for _, h := range failed {
+		store.hints[nodeID] = append(store.hints[nodeID], h)
+		store.bytes += h.size()
+	}
+}
+
+// pending tells whether there are hints waiting for a node
+func (store *hintStore) pending(nodeID string) bool {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	return len(store.hints[nodeID]) > 0 && !store.replaying[nodeID]
+}
+
+// expire drops hints past their lifetime and returns how many were dropped
+func (store *hintStore) expire(now time.Time) int {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	dropped := 0
+	for nodeID, hints := range store.hints {
+		live := hints[:0]
+		for _, h := range hints {
+			if now.Before(h.expires) {
+				live = append(live, h)
+				continue
+			}
+
+			store.bytes -= h.size()
+			dropped++
+		}
+
+		if len(live) == 0 {
+			delete(store.hints, nodeID)
+		} else {
+			store.hints[nodeID] = live
+		}
+	}
+
+	return dropped
+}
+
+// -----------------------------------------------------------------------
+
+// storeHint keeps a write for a node that could not be reached
+func (cache *distributedCache) storeHint(cnode *cacheNode, copy int, key string, data cacheData) {
+	if !cache.hints.add(cnode.ID, key, data, copy) {
+		logMessage(LOG_WARNING, "hint store full, dropping write of key: "+key+" for "+cnode.ID)
+		cache.stats.hintsDropped.Add(1)
+		return
+	}
+
+	logMessage(LOG_DEBUG, "stored hint of key: "+key+" for "+cnode.ID)
+	cache.stats.hintsStored.Add(1)
+}
+
+// replayHints delivers the writes a node missed while it was unreachable
+func (cache *distributedCache) replayHints(nodeID string) {
+	hints := cache.hints.take(nodeID)
+	if hints == nil {
+		return
+	}
+
+	cnode := cache.getNodeByID(nodeID)
+	if cnode == nil {
+		cache.hints.done(nodeID, hints)
+		return
+	}
+
+	logMessage(LOG_INFO, "replaying "+fmt.Sprintf("%d", len(hints))+" hints to "+nodeID)
+
+	// Each hint is bounded, a node that stops answering mid replay gets its remaining hints back on the next heartbeat
+	failed := []hint{}
+	for _, h := range hints {
+		ctx, cancel := cache.backgroundContext()
+		err := cache.putToNode(ctx, cnode, h.copy, h.key, h.data)
+		cancel()
+
+		if err != nil {
+			failed = append(failed, h)
+			continue
+		}
+
+		cache.stats.hintsReplayed.Add(1)
+	}
+
+	cache.hints.done(nodeID, failed)
+}
@@ -0,0 +1,138 @@
+package vitarit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrHandoffTimeout is returned when a leaving node could not hand all its keys over before the deadline
+var ErrHandoffTimeout = errors.New("handoff deadline exceeded")
+
+// ErrHandoffFailed is returned when a next owner did not acknowledge a key handed over by a leaving node
+var ErrHandoffFailed = errors.New("handoff not acknowledged")
+
+// -----------------------------------------------------------------------
+
+// announceLeave multicasts that this node is leaving so peers drop it without waiting for the heartbeat timeout
+// Heartbeats sent from now on carry the same announcement, so a lost datagram is repeated
+func (cache *distributedCache) announceLeave(node nodeInfo) error {
+	cache.leaving.Store(true)
+
+	node.Leaving = true
+	data, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	_, err = cache.write(data)
+	return err
+}
+
+// peerLeaving drops a node which announced it is leaving, its keys are re-created by the rebalance that follows
+func (cache *distributedCache) peerLeaving(nodeID string) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if _, found := cache.nodeHB[nodeID]; !found {
+		return
+	}
+
+	logMessage(LOG_INFO, nodeID+" is leaving the ring")
+	cache.removeNode_unlocked(nodeID)
+}
+
+// leave announces this node is leaving, hands its keys to their next owners and stops the cache
+// Cache is stopped even when the deadline passes, keys not yet handed over are then lost with this node
+func (cache *distributedCache) leave(timeout time.Duration) error {
+	if err := cache.announceLeave(cache.local.nodeInfo); err != nil {
+		logMessage(LOG_ERROR, "failed to announce leave of "+cache.local.ID+": "+err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := cache.handoff(ctx)
+	cache.stop()
+
+	return err
+}
+
+// handoff streams every local key to the nodes owning it once this node is gone
+// It waits for each copy to be acknowledged and gives up when ctx is done, requests in flight are cancelled with it
+// so nothing touches the store once handoff returns. Keys a next owner did not acknowledge fail it with ErrHandoffFailed
+func (cache *distributedCache) handoff(ctx context.Context) error {
+	to := cache.hashRing.snapshot()
+	to.removeNode(cache.local.ID)
+
+	entries := cache.local.digests()
+	logMessage(LOG_INFO, fmt.Sprintf("handing %d keys of %s over to %d nodes", len(entries), cache.local.ID, len(to.nodes)))
+
+	moved, failed := 0, 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err := cache.handoffKey(ctx, entry.Key, cache.hashRing.ownerIDs(entry.Key, cache.redundancy), to.ownerIDs(entry.Key, cache.redundancy)); err != nil {
+			failed++
+			continue
+		}
+		moved++
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %d of %d keys handed over", ErrHandoffTimeout, moved, len(entries))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d keys handed over, %d lost with %s", ErrHandoffFailed, moved, len(entries), failed, cache.local.ID)
+	}
+
+	return nil
+}
+
+// handoffKey sends the local copy or tombstone of a key to the owners which did not hold it while this node was a member
+// It fails when any of them did not acknowledge its copy, the others still got theirs
+func (cache *distributedCache) handoffKey(ctx context.Context, key string, oldOwners []string, newOwners []string) error {
+	data, found := cache.local.lookup(key)
+	if !found {
+		// Key was removed meanwhile, nothing is left to hand over
+		return nil
+	}
+
+	wasOwner := make(map[string]bool)
+	for _, id := range oldOwners {
+		wasOwner[id] = true
+	}
+
+	var err error
+	for copy, id := range newOwners {
+		if wasOwner[id] {
+			// Surviving owners keep their copy, they only renumber it in their own rebalance
+			continue
+		}
+
+		target := cache.getNodeByID(id)
+		if target == nil {
+			logMessage(LOG_ERROR, "handoff: owner "+id+" of key: "+key+" left the ring")
+			cache.stats.handoffFailed.Add(1)
+			err = fmt.Errorf("owner %s of key %s left the ring", id, key)
+			continue
+		}
+
+		logMessage(LOG_DEBUG, "handoff: moving key: "+key+" to "+id+" with copy factor "+fmt.Sprintf("%d", copy))
+		if putErr := cache.putToNode(ctx, target, copy, key, data); putErr != nil {
+			logMessage(LOG_ERROR, "handoff: failed to move key: "+key+" to "+id)
+			cache.stats.handoffFailed.Add(1)
+			err = putErr
+			continue
+		}
+
+		cache.stats.handoffKeys.Add(1)
+	}
+
+	return err
+}
@@ -1,5 +1,7 @@
 package vitarit
 
+import "sync/atomic"
+
 const (
 	LOG_DEBUG = iota
 	LOG_INFO
@@ -8,10 +10,11 @@ const (
 	LOG_CRITICAL
 )
 
-var logFunc func(int, string)
+// logFunc is swapped atomically as background goroutines log while the logger is replaced
+var logFunc atomic.Pointer[func(int, string)]
 
 func logMessage(level int, message string) {
-	if logFunc != nil {
-		logFunc(level, message)
+	if f := logFunc.Load(); f != nil && *f != nil {
+		(*f)(level, message)
 	}
 }
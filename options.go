@@ -0,0 +1,315 @@
+package vitarit
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultVirtualNodes   = 1         // One point per node keeps placement compatible with older peers
+	defaultTombstoneGrace = time.Hour // Removed keys are remembered this long, longer than hints live and anti-entropy rounds take
+)
+
+// Consistency sets how many copies of a key a Get has to hear from
+type Consistency int
+
+const (
+	ConsistencyOne    Consistency = iota // First copy that has the key answers, copies are tried in order
+	ConsistencyQuorum                    // Majority of the copies answer, newest version wins
+	ConsistencyAll                       // Every copy answers, newest version wins
+)
+
+// replicas returns number of answers needed out of the given number of copies
+func (c Consistency) replicas(copies int) int {
+	switch c {
+	case ConsistencyQuorum:
+		return copies/2 + 1
+	case ConsistencyAll:
+		return copies
+	default:
+		return 1
+	}
+}
+
+// config holds the tunables of a Vitarit instance, all nodes in a group are expected to agree on these
+type config struct {
+	virtualNodes int            // Number of points placed on the ring per unit of node weight
+	hasher       Hasher         // Hash function used to place nodes and keys on the ring
+	placement    Placement      // Algorithm used to pick owners of a key
+	loadFactor   float64        // Bounded load capacity factor, 0 disables bounded loads
+	hashTags     bool           // Hash only the {tag} part of keys
+	writeQuorum  int            // Number of copies that must acknowledge a Set
+	consistency  Consistency    // Number of copies a Get has to hear from
+	timeout      time.Duration  // Deadline of a Get, Set or Remove, 0 waits for the nodes to answer
+	hintBytes    int            // Memory bound of hints kept for unreachable owners
+	hintTTL      time.Duration  // Lifetime of a hint
+	syncInterval time.Duration  // Time between anti-entropy rounds, 0 disables the background rounds
+	syncRate     int            // Keys streamed per second by anti-entropy
+	tombstoneGC  time.Duration  // Time a removed key is remembered before its tombstone is purged
+	maxBytes     int            // Memory bound of keys and values held by the local node, 0 is unbounded
+	eviction     EvictionPolicy // Algorithm picking the keys the local node drops beyond maxBytes
+	shards       int            // Independently locked parts of the local store, a power of two
+	store        Store          // Keeps the keys of the local node, nil keeps them in memory
+}
+
+// Option configures a Vitarit instance at construction time
+type Option func(*Vitarit)
+
+// defaultConfig returns the configuration used when no options are supplied
+func defaultConfig() config {
+	return config{
+		virtualNodes: defaultVirtualNodes,
+		hasher:       CRC32Hasher,
+		placement:    PlacementRing,
+		writeQuorum:  1,
+		hintBytes:    defaultHintBytes,
+		hintTTL:      defaultHintTTL,
+		syncInterval: defaultSyncInterval,
+		syncRate:     defaultSyncKeysPerSec,
+		tombstoneGC:  defaultTombstoneGrace,
+		eviction:     EvictLRU,
+		shards:       defaultShards,
+	}
+}
+
+// -----------------------------------------------------------------------
+
+// WithVirtualNodes sets how many virtual nodes are placed on the ring for each unit of weight, every node of the group must use the same count
+func WithVirtualNodes(count int) Option {
+	return func(v *Vitarit) {
+		if count > 0 {
+			v.config.virtualNodes = count
+		}
+	}
+}
+
+// WithHasher selects the hash function used for ring placement, every node of the group must use the same one
+func WithHasher(hasher Hasher) Option {
+	return func(v *Vitarit) {
+		if hasher != nil {
+			v.config.hasher = hasher
+		}
+	}
+}
+
+// WithPlacement selects the algorithm used to pick owners of a key, every node of the group must use the same one
+// PlacementJump moves most keys whenever a node other than the one with the highest ID joins or leaves
+func WithPlacement(placement Placement) Option {
+	return func(v *Vitarit) {
+		switch placement {
+		case PlacementRing, PlacementRendezvous, PlacementJump:
+			v.config.placement = placement
+		default:
+			logMessage(LOG_ERROR, "unknown placement "+string(placement)+", using "+string(v.config.placement))
+		}
+	}
+}
+
+// WithBoundedLoad enables consistent hashing with bounded loads
+// A node owning more than (1+epsilon) times the average key count keeps about that many and the rest of its keys
+// overflow to the next node, keys are moved as the share it keeps changes. Every node of the group must use the same epsilon
+func WithBoundedLoad(epsilon float64) Option {
+	return func(v *Vitarit) {
+		if epsilon > 0 {
+			v.config.loadFactor = epsilon
+		}
+	}
+}
+
+// WithHashTags makes placement hash only the substring inside the first {...} of a key
+// Keys sharing a tag such as order:{42}:items and order:{42}:status are stored on the same nodes
+func WithHashTags() Option {
+	return func(v *Vitarit) {
+		v.config.hashTags = true
+	}
+}
+
+// WithWriteQuorum sets how many copies must acknowledge a Set before it succeeds
+// Quorum larger than the number of copies is capped, so a single node cluster keeps working
+func WithWriteQuorum(w int) Option {
+	return func(v *Vitarit) {
+		if w > 0 {
+			v.config.writeQuorum = w
+		}
+	}
+}
+
+// WithReadConsistency sets how many copies a Get queries and reconciles
+func WithReadConsistency(consistency Consistency) Option {
+	return func(v *Vitarit) {
+		v.config.consistency = consistency
+	}
+}
+
+// WithRequestTimeout sets how long a Get, Set or Remove may take before it fails, zero waits for the nodes
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(v *Vitarit) {
+		v.config.timeout = max(timeout, 0)
+	}
+}
+
+// WithHintedHandoff bounds the writes kept for unreachable owners, zero maxBytes disables hinted handoff
+func WithHintedHandoff(maxBytes int, ttl time.Duration) Option {
+	return func(v *Vitarit) {
+		v.config.hintBytes = max(maxBytes, 0)
+		if ttl > 0 {
+			v.config.hintTTL = ttl
+		}
+	}
+}
+
+// WithAntiEntropy sets how often replicas compare their keys and how many keys per second they may stream
+// Zero interval disables the background rounds, they can still be run through AntiEntropy
+func WithAntiEntropy(interval time.Duration, keysPerSecond int) Option {
+	return func(v *Vitarit) {
+		v.config.syncInterval = max(interval, 0)
+		if keysPerSecond > 0 {
+			v.config.syncRate = keysPerSecond
+		}
+	}
+}
+
+// WithTombstoneGrace sets how long a removed key is remembered
+// A copy of the key older than the remove that shows up after the grace period can bring the key back,
+// so it should outlive hints and the time between anti-entropy rounds
+func WithTombstoneGrace(grace time.Duration) Option {
+	return func(v *Vitarit) {
+		if grace > 0 {
+			v.config.tombstoneGC = grace
+		}
+	}
+}
+
+// WithMaxBytes bounds memory of the keys and values held by this node, zero keeps it unbounded
+// Keys picked by the eviction policy are dropped beyond the bound, replica copies before primaries,
+// and a set of a value larger than the whole bound fails
+func WithMaxBytes(maxBytes int) Option {
+	return func(v *Vitarit) {
+		v.config.maxBytes = max(maxBytes, 0)
+	}
+}
+
+// WithEvictionPolicy selects the algorithm picking the keys this node drops once it reaches WithMaxBytes
+// HitRatio replays a trace of keys with a policy so the policies can be compared on a workload first
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(v *Vitarit) {
+		switch policy {
+		case EvictLRU, EvictLFU, EvictARC, EvictTinyLFU:
+			v.config.eviction = policy
+		default:
+			logMessage(LOG_ERROR, "unknown eviction policy "+string(policy)+", using "+string(v.config.eviction))
+		}
+	}
+}
+
+// WithShards splits the store of this node into count independently locked shards, rounded up to a power of two
+// More shards let more writers in at once, the memory bound of WithMaxBytes holds for all of them together
+func WithShards(count int) Option {
+	return func(v *Vitarit) {
+		if count > 0 {
+			v.config.shards = count
+		}
+	}
+}
+
+// WithStore makes this node keep its keys in the given store instead of in memory, only the local node uses it
+// The store is shared by every shard so it must be safe for concurrent use, it is closed when the node stops
+func WithStore(store Store) Option {
+	return func(v *Vitarit) {
+		if store != nil {
+			v.config.store = store
+		}
+	}
+}
+
+// WithWeight sets the weight this node advertises, a node with weight 2 owns roughly twice the keys
+func WithWeight(weight int) Option {
+	return func(v *Vitarit) {
+		if weight > 0 {
+			v.node.Weight = weight
+		}
+	}
+}
+
+// WithZone sets the zone this node advertises, replicas of a key are spread over distinct zones first
+func WithZone(zone string) Option {
+	return func(v *Vitarit) {
+		v.node.Zone = zone
+	}
+}
+
+// WithRack sets the rack this node advertises within its zone
+func WithRack(rack string) Option {
+	return func(v *Vitarit) {
+		v.node.Rack = rack
+	}
+}
+
+// -----------------------------------------------------------------------
+
+// CallOption overrides the instance configuration for a single Get, Set or Remove
+type CallOption func(*callOptions)
+
+// callOptions are the guarantees a single call asks for
+type callOptions struct {
+	consistency Consistency   // Number of copies a read has to hear from
+	writeQuorum int           // Number of copies that must acknowledge a write
+	timeout     time.Duration // Deadline of the whole call, 0 waits for the nodes to answer
+	async       bool          // Write returns once it is sent, failures are only logged
+}
+
+// callOptions returns the guarantees of a call, the instance configuration overridden by opts
+func (cfg config) callOptions(opts ...CallOption) callOptions {
+	options := callOptions{
+		consistency: cfg.consistency,
+		writeQuorum: cfg.writeQuorum,
+		timeout:     cfg.timeout,
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// context returns the context requests of the call are sent with
+func (opts callOptions) context() (context.Context, context.CancelFunc) {
+	if opts.timeout > 0 {
+		return context.WithTimeout(context.Background(), opts.timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// WithConsistency sets how many copies this Get queries and reconciles
+func WithConsistency(consistency Consistency) CallOption {
+	return func(opts *callOptions) {
+		opts.consistency = consistency
+	}
+}
+
+// WithAcks sets how many copies must acknowledge this Set or Remove, capped to the number of copies
+func WithAcks(acks int) CallOption {
+	return func(opts *callOptions) {
+		if acks > 0 {
+			opts.writeQuorum = acks
+		}
+	}
+}
+
+// WithTimeout sets how long this call may take, copies which did not answer by then count as failed
+func WithTimeout(timeout time.Duration) CallOption {
+	return func(opts *callOptions) {
+		opts.timeout = max(timeout, 0)
+	}
+}
+
+// WithAsync makes this Set or Remove return as soon as it is sent, without waiting for acknowledgements
+// Failures are only logged, unreachable copies still get the write through hinted handoff
+// Copies nobody waits for are bounded by the timeout of the call, or of the instance, or ten seconds without one
+func WithAsync() CallOption {
+	return func(opts *callOptions) {
+		opts.async = true
+	}
+}
@@ -27,6 +27,7 @@ const (
 	multicastAddress  = "224.0.0.1:8454"
 	heartbeatInterval = 2 * time.Second
 	monitorInterval   = 10 * time.Second
+	heartbeatBytes    = 4096 // Largest heartbeat sent and received, a larger datagram would be cut off
 )
 
 type peerDiscovery struct {
@@ -35,7 +36,7 @@ type peerDiscovery struct {
 	sendConn *net.UDPConn // UDP peerdection for sending heartbeats
 	recvConn *net.UDPConn // UDP peerdection for receiving heartbeats
 
-	ctx    context.Context    // Context for the Vitarit struct
+	ctx    context.Context    // Context for the Vitarit struct, created with the cache so anti-entropy and the sweeper wait on it even when multicast fails
 	cancel context.CancelFunc // Cancel function for the Vitarit struct
 }
 
@@ -49,12 +50,9 @@ func (cache *distributedCache) startDiscovery(node nodeInfo) {
 		return
 	}
 
-	// Create context to stop the peer discovery
-	cache.ctx, cache.cancel = context.WithCancel(context.Background())
-
 	go cache.monitorHeartbeats(node.ID)
 	go cache.sendHeartbeats(node)
-	go cache.receiveHeartbeats(node.ID, node.GroupID)
+	go cache.receiveHeartbeats(node)
 }
 
 // stop peer discovery and close the peerdections
@@ -62,9 +60,16 @@ func (cache *distributedCache) stopDiscovery() error {
 	// Stop all threads
 	cache.cancel()
 
-	// Close UDP connections used for heartbeat
-	err1 := cache.sendConn.Close()
-	err2 := cache.recvConn.Close()
+	// Close UDP connections used for heartbeat, those multicast setup got to open
+	var err1, err2 error
+	if cache.sendConn != nil {
+		err1 = cache.sendConn.Close()
+	}
+
+	if cache.recvConn != nil {
+		err2 = cache.recvConn.Close()
+	}
+
 	if err1 != nil {
 		return err1
 	}
@@ -124,17 +129,26 @@ func (cache *distributedCache) sendHeartbeats(node nodeInfo) {
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
-	data, err := json.Marshal(node)
-	if err != nil {
-		logMessage(LOG_ERROR, "failed to marshal heartbeat message: "+err.Error())
-		return
-	}
-
 	for {
 		select {
 		case <-cache.ctx.Done():
 			return
 		case <-ticker.C:
+			// Advertise current key count, peers use it to bound the load of each node
+			// Own ring entry takes the same value so this node decides like its peers do
+			node.Load, node.Overflow = cache.localLoad(node.ID)
+			node.Leaving = cache.leaving.Load()
+
+			data, err := encodeHeartbeat(&node)
+			if err != nil {
+				logMessage(LOG_ERROR, "failed to marshal heartbeat message: "+err.Error())
+				continue
+			}
+
+			cache.mtx.Lock()
+			cache.refreshLoad_unlocked(node.ID, node.Load, node.Overflow)
+			cache.mtx.Unlock()
+
 			_, err = cache.write(data)
 			if err != nil {
 				logMessage(LOG_ERROR, "failed to send heartbeat message from "+node.ID+": "+err.Error())
@@ -145,10 +159,78 @@ func (cache *distributedCache) sendHeartbeats(node nodeInfo) {
 	}
 }
 
+// encodeHeartbeat marshals the heartbeat of a node so that it fits in heartbeatBytes
+// Overflow counts of the fewest keys are left out until it fits, those keys then count as owned by the node itself
+func encodeHeartbeat(node *nodeInfo) ([]byte, error) {
+	advertised := len(node.Overflow)
+
+	for {
+		data, err := json.Marshal(node)
+		if err != nil || len(data) <= heartbeatBytes {
+			if len(node.Overflow) < advertised {
+				logMessage(LOG_ERROR, fmt.Sprintf("heartbeat of %s too large, advertising overflow of %d out of %d full nodes", node.ID, len(node.Overflow), advertised))
+			}
+			return data, err
+		}
+
+		if len(node.Overflow) == 0 {
+			return nil, fmt.Errorf("heartbeat of %s is %d bytes, above the limit of %d", node.ID, len(data), heartbeatBytes)
+		}
+
+		smallest := ""
+		for id, count := range node.Overflow {
+			if smallest == "" || count < node.Overflow[smallest] || (count == node.Overflow[smallest] && id > smallest) {
+				smallest = id
+			}
+		}
+		delete(node.Overflow, smallest)
+	}
+}
+
+// checkCompatible returns an error when a peer places keys differently than this node would
+func checkCompatible(me nodeInfo, peer nodeInfo) error {
+	vnodes := peer.VNodes
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+
+	if vnodes != me.VNodes {
+		return fmt.Errorf("node %s places %d virtual nodes while %s places %d", peer.ID, vnodes, me.ID, me.VNodes)
+	}
+
+	hasher := peer.Hasher
+	if hasher == "" {
+		hasher = defaultHasherName
+	}
+
+	if hasher != me.Hasher {
+		return fmt.Errorf("node %s uses hasher %s while %s uses %s", peer.ID, hasher, me.ID, me.Hasher)
+	}
+
+	placement := peer.Placement
+	if placement == "" {
+		placement = string(PlacementRing)
+	}
+
+	if placement != me.Placement {
+		return fmt.Errorf("node %s uses placement %s while %s uses %s", peer.ID, placement, me.ID, me.Placement)
+	}
+
+	if peer.LoadFactor != me.LoadFactor {
+		return fmt.Errorf("node %s bounds loads with factor %g while %s uses %g", peer.ID, peer.LoadFactor, me.ID, me.LoadFactor)
+	}
+
+	if peer.HashTags != me.HashTags {
+		return fmt.Errorf("node %s hash tags enabled %v while %s has %v", peer.ID, peer.HashTags, me.ID, me.HashTags)
+	}
+
+	return nil
+}
+
 // receiveHeartbeats listens for heartbeats from the network
-func (cache *distributedCache) receiveHeartbeats(myNodeID string, myGroupID string) {
-	var node nodeInfo
-	buf := make([]byte, 1024)
+func (cache *distributedCache) receiveHeartbeats(me nodeInfo) {
+	// One byte more than a heartbeat may take tells a datagram was cut off
+	buf := make([]byte, heartbeatBytes+1)
 
 	for {
 		select {
@@ -157,26 +239,49 @@ func (cache *distributedCache) receiveHeartbeats(myNodeID string, myGroupID stri
 		default:
 			n, src, err := cache.readFromUDP(buf)
 			if err != nil {
+				if cache.ctx.Err() != nil {
+					// Socket was closed because discovery stopped
+					return
+				}
 				logMessage(LOG_ERROR, "error reading from udp: "+err.Error())
 				continue
 			}
 
+			if n > heartbeatBytes {
+				logMessage(LOG_ERROR, "dropping heartbeat from "+src.String()+" larger than "+fmt.Sprint(heartbeatBytes)+" bytes")
+				continue
+			}
+
+			// Fresh struct per heartbeat so fields missing in this message do not leak from the previous one
+			var node nodeInfo
 			err = json.Unmarshal(buf[:n], &node)
 			if err != nil {
 				logMessage(LOG_ERROR, "fail to parse heartbeat: "+err.Error())
 				continue
 			}
 
-			if node.ID == myNodeID {
+			if node.ID == me.ID {
 				// As loopback is enabled we might receive our own heartbeats as well
 				continue
 			}
 
-			if node.GroupID != myGroupID {
+			if node.GroupID != me.GroupID {
 				// This node does not belong to your group so ignore the HB
 				continue
 			}
 
+			if err = checkCompatible(me, node); err != nil {
+				// Mixing virtual node counts, hash functions, placements, load factors or hash tags would route same key to different owners, keep this node out of the ring
+				logMessage(LOG_ERROR, "rejecting heartbeat: "+err.Error())
+				continue
+			}
+
+			if node.Leaving {
+				// Node is handing its keys over, drop it now rather than waiting for its heartbeats to time out
+				cache.peerLeaving(node.ID)
+				continue
+			}
+
 			logMessage(LOG_DEBUG, "received heartbeat from "+node.ID+" IP: "+src.IP.String()+" Port: "+fmt.Sprint(src.Port)+" GroupID: "+node.GroupID)
 
 			cache.addNode(node)
@@ -213,6 +318,16 @@ func (cache *distributedCache) monitorHeartbeats(myNodeID string) {
 				}
 			}
 			cache.mtx.Unlock()
+
+			if dropped := cache.hints.expire(now); dropped > 0 {
+				logMessage(LOG_WARNING, fmt.Sprintf("dropped %d expired hints", dropped))
+				cache.stats.hintsDropped.Add(uint64(dropped))
+			}
+
+			if purged := cache.local.purge(now.Add(-cache.config.tombstoneGC)); purged > 0 {
+				logMessage(LOG_DEBUG, fmt.Sprintf("purged %d tombstones", purged))
+				cache.stats.tombstonesPurged.Add(uint64(purged))
+			}
 		}
 	}
 }
@@ -0,0 +1,199 @@
+package vitarit
+
+import (
+	"math"
+	"sort"
+)
+
+// Placement names the algorithm used to pick the nodes owning a key
+// All nodes of a group must use the same placement, it is advertised in heartbeats
+type Placement string
+
+const (
+	PlacementRing       Placement = "ring"       // Walk clockwise on the sorted ring of virtual nodes (default)
+	PlacementRendezvous Placement = "rendezvous" // Highest random weight, every node scores every key
+	PlacementJump       Placement = "jump"       // Jump consistent hash over nodes ordered by ID, only for groups that grow and shrink at the end
+)
+
+// placementStrategy picks distinct physical nodes for a key in order of preference
+// Implementations are called with the ring lock held
+type placementStrategy interface {
+	pick(ring *hashRing, key string, count int) []*cacheNode
+	ownership(ring *hashRing) map[string]float64 // Fraction of the hash space owned per node ID
+}
+
+// newPlacementStrategy returns implementation of the named placement, falling back to the ring walk
+func newPlacementStrategy(p Placement) placementStrategy {
+	switch p {
+	case PlacementRendezvous:
+		return rendezvousPlacement{}
+	case PlacementJump:
+		return jumpPlacement{}
+	default:
+		return ringPlacement{}
+	}
+}
+
+// -----------------------------------------------------------------------
+
+// ringPlacement walks clockwise from the key hash and takes the first distinct nodes it meets
+type ringPlacement struct{}
+
+func (ringPlacement) pick(ring *hashRing, key string, count int) []*cacheNode {
+	nodes := []*cacheNode{}
+	if len(ring.sortedHashes) == 0 {
+		return nodes
+	}
+
+	// Adjacent virtual nodes may belong to the same host, skip those so every copy is on a different node
+	seen := make(map[string]bool)
+	idx := ring.search(ring.hasher.Sum64([]byte(key)))
+
+	for i := 0; i < len(ring.sortedHashes) && len(nodes) < count; i++ {
+		cnode := ring.nodeMap[ring.sortedHashes[(idx+i)%len(ring.sortedHashes)]]
+		if seen[cnode.ID] {
+			continue
+		}
+
+		seen[cnode.ID] = true
+		nodes = append(nodes, cnode)
+	}
+
+	return nodes
+}
+
+// ownership sums the arcs ending at each virtual node, an arc belongs to the node at its clockwise end
+func (ringPlacement) ownership(ring *hashRing) map[string]float64 {
+	owned := make(map[string]float64)
+	if len(ring.sortedHashes) == 0 {
+		return owned
+	}
+
+	bits := hashSpaceBits(ring.hasher)
+	mask := uint64(1)<<bits - 1
+	if bits == 64 {
+		mask = ^uint64(0)
+	}
+
+	prev := ring.sortedHashes[len(ring.sortedHashes)-1]
+	for _, hash := range ring.sortedHashes {
+		arc := (hash - prev) & mask
+		if len(ring.sortedHashes) == 1 {
+			arc = mask
+		}
+
+		owned[ring.nodeMap[hash].ID] += float64(arc) / float64(mask)
+		prev = hash
+	}
+
+	return owned
+}
+
+// -----------------------------------------------------------------------
+
+// rendezvousPlacement scores each node against the key and prefers the highest scores
+// Removing a node only moves the keys it owned, and replicas of a key are spread independently
+type rendezvousPlacement struct{}
+
+// rendezvousScore is the weighted HRW score of a node for a key, -w/ln(u) with u uniform in (0, 1)
+// u needs all 64 bits and independent values per node, so it is hashed with xxHash64 whatever the ring hasher is:
+// a 32 bit hasher leaves u close to 0 and CRC32 of the same key with different node IDs is correlated
+func rendezvousScore(key string, cnode *cacheNode) float64 {
+	h := XXHash64.Sum64([]byte(key + "\x00" + cnode.ID))
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+
+	weight := cnode.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	return -float64(weight) / math.Log(u)
+}
+
+func (rendezvousPlacement) pick(ring *hashRing, key string, count int) []*cacheNode {
+	type scored struct {
+		node  *cacheNode
+		score float64
+	}
+
+	scores := make([]scored, 0, len(ring.nodes))
+	for _, cnode := range ring.nodes {
+		scores = append(scores, scored{cnode, rendezvousScore(key, cnode)})
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score == scores[j].score {
+			return scores[i].node.ID < scores[j].node.ID
+		}
+		return scores[i].score > scores[j].score
+	})
+
+	nodes := []*cacheNode{}
+	for i := 0; i < len(scores) && len(nodes) < count; i++ {
+		nodes = append(nodes, scores[i].node)
+	}
+
+	return nodes
+}
+
+// ownership of rendezvous is the expected share, each node wins keys in proportion to its weight
+func (rendezvousPlacement) ownership(ring *hashRing) map[string]float64 {
+	owned := make(map[string]float64)
+
+	total := 0
+	for _, cnode := range ring.nodes {
+		total += max(cnode.Weight, 1)
+	}
+
+	for _, cnode := range ring.nodes {
+		owned[cnode.ID] = float64(max(cnode.Weight, 1)) / float64(total)
+	}
+
+	return owned
+}
+
+// -----------------------------------------------------------------------
+
+// jumpPlacement maps the key to a bucket with jump consistent hash, replicas take the following buckets
+// Buckets are the nodes sorted by ID, so weights and virtual nodes are ignored
+// Jump hash only keeps keys in place when the last bucket is added or removed, so membership is stable only while
+// nodes join with an ID above every member and the highest ID leaves first. Any other join or leave renumbers the
+// buckets after it and moves most keys between surviving nodes, each such change is close to a full migration
+type jumpPlacement struct{}
+
+// jumpHash is the jump consistent hash of Lamping and Veach
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
+
+func (jumpPlacement) pick(ring *hashRing, key string, count int) []*cacheNode {
+	nodes := []*cacheNode{}
+	if len(ring.nodes) == 0 {
+		return nodes
+	}
+
+	bucket := jumpHash(ring.hasher.Sum64([]byte(key)), len(ring.nodes))
+	for i := 0; i < len(ring.nodes) && len(nodes) < count; i++ {
+		nodes = append(nodes, ring.nodes[(bucket+i)%len(ring.nodes)])
+	}
+
+	return nodes
+}
+
+// ownership of jump hash is an equal share per bucket
+func (jumpPlacement) ownership(ring *hashRing) map[string]float64 {
+	owned := make(map[string]float64)
+	for _, cnode := range ring.nodes {
+		owned[cnode.ID] = 1 / float64(len(ring.nodes))
+	}
+
+	return owned
+}
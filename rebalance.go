@@ -0,0 +1,222 @@
+package vitarit
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+)
+
+// rebalanceDelay lets a burst of joins settle, and the new nodes learn the ring, before keys are moved
+const rebalanceDelay = 2 * heartbeatInterval
+
+// snapshot returns a copy of the ring placing keys as the ring does now
+// Nodes are copied without their data, loads are frozen at the time of the snapshot
+func (ring *hashRing) snapshot() *hashRing {
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+
+	snap := &hashRing{
+		sortedHashes: append([]uint64{}, ring.sortedHashes...),
+		nodeMap:      make(map[uint64]*cacheNode, len(ring.nodeMap)),
+		idMap:        make(map[string]*cacheNode, len(ring.idMap)),
+		vnodes:       make(map[string][]uint64, len(ring.vnodes)),
+		virtualNodes: ring.virtualNodes,
+		hasher:       ring.hasher,
+		strategy:     ring.strategy,
+		loadFactor:   ring.loadFactor,
+		shares:       maps.Clone(ring.shares),
+		hashTags:     ring.hashTags,
+		version:      ring.version,
+		digest:       ring.digest,
+	}
+
+	for _, cnode := range ring.nodes {
+		clone := &cacheNode{nodeInfo: cnode.nodeInfo}
+		snap.nodes = append(snap.nodes, clone)
+		snap.idMap[cnode.ID] = clone
+		snap.vnodes[cnode.ID] = ring.vnodes[cnode.ID]
+
+		for _, hash := range ring.vnodes[cnode.ID] {
+			snap.nodeMap[hash] = clone
+		}
+	}
+
+	return snap
+}
+
+// ownerIDs returns IDs of the nodes a key belongs to in this ring, owner first
+func (ring *hashRing) ownerIDs(key string, redundancy int) []string {
+	ids := []string{}
+	for _, cnode := range ring.getNodes(key, redundancy) {
+		ids = append(ids, cnode.ID)
+	}
+
+	return ids
+}
+
+// -----------------------------------------------------------------------
+
+// ringChanging is called before a node joins or leaves the ring
+// It keeps the placement the local keys were stored with and schedules a rebalance against the new one
+func (cache *distributedCache) ringChanging() {
+	cache.rebalanceMtx.Lock()
+	defer cache.rebalanceMtx.Unlock()
+
+	if cache.local == nil {
+		// Cache is not started yet, it holds no keys
+		return
+	}
+
+	if cache.rebalanceFrom == nil {
+		cache.rebalanceFrom = cache.hashRing.snapshot()
+	}
+
+	if cache.rebalanceTimer == nil {
+		cache.rebalanceTimer = time.AfterFunc(rebalanceDelay, cache.rebalanceAfterChange)
+	} else {
+		cache.rebalanceTimer.Reset(rebalanceDelay)
+	}
+}
+
+// rebalanceAfterChange moves keys from the placement before the membership changes to the current one
+func (cache *distributedCache) rebalanceAfterChange() {
+	cache.rebalanceMtx.Lock()
+	from := cache.rebalanceFrom
+	cache.rebalanceFrom = nil
+	cache.rebalanceTimer = nil
+	cache.rebalanceMtx.Unlock()
+
+	if from == nil || cache.rebalanceCtx.Err() != nil {
+		return
+	}
+
+	cache.rebalance(from, cache.hashRing.snapshot())
+}
+
+// rebalance streams the local keys to the nodes that own them in the new ring but did not in the old one
+// For each key only one holder sends, the first owner present in both rings or this node when there is none
+// On a join this moves keys to the new node, on an eviction it re-creates the lost copies on the next nodes
+// Copies this node no longer owns are dropped once every new owner confirmed it holds them, the others take
+// their new copy number, so a replica whose owner left becomes copy 0
+// Stopping the cache cancels the requests in flight and ends the rebalance before the next key
+func (cache *distributedCache) rebalance(from *hashRing, to *hashRing) {
+	cache.rebalancing.Lock()
+	defer cache.rebalancing.Unlock()
+
+	ctx := cache.rebalanceCtx
+	if ctx.Err() != nil {
+		// Cache stopped while this rebalance waited for the previous one
+		return
+	}
+
+	entries := cache.local.digests()
+	cache.stats.rebalancePending.Store(uint64(len(entries)))
+	cache.stats.rebalanceRounds.Add(1)
+
+	logMessage(LOG_INFO, fmt.Sprintf("rebalancing %d keys from epoch %s to %s", len(entries), from.digest, to.digest))
+
+	for idx, entry := range entries {
+		if ctx.Err() != nil {
+			logMessage(LOG_INFO, fmt.Sprintf("rebalance stopped with %d of %d keys left", len(entries)-idx, len(entries)))
+			cache.stats.rebalancePending.Store(0)
+			return
+		}
+
+		cache.rebalanceKey(ctx, entry.Key, from.ownerIDs(entry.Key, cache.redundancy), to.ownerIDs(entry.Key, cache.redundancy))
+		cache.stats.rebalancePending.Add(^uint64(0))
+	}
+}
+
+// rebalanceKey hands one local key over to its new owners, tombstones move like values
+func (cache *distributedCache) rebalanceKey(ctx context.Context, key string, oldOwners []string, newOwners []string) {
+	data, found := cache.local.lookup(key)
+	if !found {
+		return
+	}
+
+	wasOwner := make(map[string]bool)
+	for _, id := range oldOwners {
+		wasOwner[id] = true
+	}
+
+	// First owner which held the key before and still owns it sends, if nobody survived this node does
+	sender := cache.local.ID
+	for _, id := range newOwners {
+		if wasOwner[id] {
+			sender = id
+			break
+		}
+	}
+
+	sent := make(map[string]bool)
+	myCopy := -1
+	for copy, id := range newOwners {
+		if id == cache.local.ID {
+			myCopy = copy
+			continue
+		}
+
+		if wasOwner[id] || sender != cache.local.ID {
+			continue
+		}
+
+		target := cache.getNodeByID(id)
+		if target == nil {
+			continue
+		}
+
+		logMessage(LOG_DEBUG, "rebalance: moving key: "+key+" to "+id+" with copy factor "+fmt.Sprintf("%d", copy))
+		if err := cache.putToNode(ctx, target, copy, key, data); err != nil {
+			logMessage(LOG_ERROR, "rebalance: failed to move key: "+key+" to "+id)
+			continue
+		}
+
+		sent[id] = true
+		cache.stats.rebalanceKeys.Add(1)
+		cache.stats.rebalanceBytes.Add(uint64(len(key) + len(data.bytes)))
+	}
+
+	if myCopy >= 0 {
+		if myCopy != data.copy {
+			cache.local.setCopy(key, myCopy)
+		}
+		return
+	}
+
+	// Sender picked above may have missed the write or not have run its own rebalance yet,
+	// so every new owner is asked for the key before this copy goes
+	for copy, id := range newOwners {
+		if !sent[id] && !cache.confirmCopy(ctx, id, copy, key, data) {
+			// Keep the copy around, anti-entropy or a later change moves it
+			return
+		}
+	}
+
+	logMessage(LOG_DEBUG, "rebalance: dropping key: "+key+" no longer owned by "+cache.local.ID)
+	cache.local.remove(key)
+	cache.stats.rebalanceDropped.Add(1)
+}
+
+// confirmCopy tells whether a node holds this version of the key or a newer one, the key is sent to it when it does not
+func (cache *distributedCache) confirmCopy(ctx context.Context, id string, copy int, key string, data cacheData) bool {
+	target := cache.getNodeByID(id)
+	if target == nil {
+		return false
+	}
+
+	read := cache.readFromNode(ctx, target, copy, key, "")
+	if read.err == nil && (read.found || read.data.tombstone()) && read.data.version >= data.version {
+		return true
+	}
+
+	logMessage(LOG_DEBUG, "rebalance: "+id+" misses key: "+key+", sending copy factor "+fmt.Sprintf("%d", copy))
+	if err := cache.putToNode(ctx, target, copy, key, data); err != nil {
+		logMessage(LOG_ERROR, "rebalance: failed to move key: "+key+" to "+id)
+		return false
+	}
+
+	cache.stats.rebalanceKeys.Add(1)
+	cache.stats.rebalanceBytes.Add(uint64(len(key) + len(data.bytes)))
+	return true
+}
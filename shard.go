@@ -0,0 +1,172 @@
+package vitarit
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const defaultShards = 32 // Independently locked parts of the store of a node, a power of two
+
+// shard holds the keys of a node that hash to it under its own lock
+// Writes to keys of different shards do not wait for each other
+type shard struct {
+	entries    Store                // Key-value pairs and tombstones of removed keys
+	keys       int                  // Number of keys in entries, tombstones included
+	tombstones int                  // Number of tombstones in entries
+	expiries   map[string]time.Time // Expiry of the keys which have one, sampled by the sweeper
+	bytes      int                  // Memory accounted to the keys and values in entries, part of the node total
+	replicas   evictionPolicy       // Orders replica copies for eviction, set when the node is bounded
+	primaries  evictionPolicy       // Orders primary copies for eviction, set when the node is bounded
+	mtx        sync.RWMutex         // Lock to protect the data
+
+	node *cacheNode // Node the shard belongs to, evictions are logged and counted on it
+}
+
+// newShard allocates an empty shard of the node keeping its keys in an in-memory map
+func newShard(node *cacheNode) *shard {
+	sh := &shard{node: node}
+	sh.reset(mapStore{})
+
+	return sh
+}
+
+// reset makes the shard keep its keys in the given store, with nothing accounted yet
+func (sh *shard) reset(store Store) {
+	sh.entries = store
+	sh.keys = 0
+	sh.tombstones = 0
+	sh.expiries = make(map[string]time.Time)
+	sh.node.bytes.Add(-int64(sh.bytes))
+	sh.bytes = 0
+}
+
+// -----------------------------------------------------------------------
+
+// split replaces the store of the node with count empty shards, count is rounded up to a power of two
+// Called before the node serves requests and before a store is attached, keys already stored are dropped
+func (cnode *cacheNode) split(count int) {
+	if count <= 0 {
+		count = defaultShards
+	}
+	count = 1 << bits.Len(uint(count-1))
+
+	cnode.bytes.Store(0)
+	cnode.shards = make([]*shard, count)
+	for i := range cnode.shards {
+		cnode.shards[i] = newShard(cnode)
+	}
+}
+
+// shardOf returns the shard holding a key
+// Hash is seeded per node and independent of the ring hasher, keys placed on this node by the ring are not all alike
+func (cnode *cacheNode) shardOf(key string) *shard {
+	return cnode.shards[maphash.String(cnode.seed, key)&uint64(len(cnode.shards)-1)]
+}
+
+// -----------------------------------------------------------------------
+
+// get returns what the shard holds for a key, called with the lock held
+func (sh *shard) get(key string) (cacheData, bool) {
+	entry, found := sh.entries.Get(key)
+	if !found {
+		return cacheData{}, false
+	}
+
+	return fromEntry(entry), true
+}
+
+// live tells whether the shard holds a value of the key which is neither removed nor expired, called with the lock held
+func (sh *shard) live(key string, now time.Time) (cacheData, bool) {
+	value, exists := sh.get(key)
+	if !exists || value.tombstone() || value.expired(now) {
+		return cacheData{}, false
+	}
+
+	return value, true
+}
+
+// supersedes tells whether what the shard holds for a key wins over a write with given version
+// Equal versions overwrite a value, but a remove is never undone by a write carrying its version
+func (sh *shard) supersedes(key string, version uint64) bool {
+	existing, found := sh.get(key)
+	if !found {
+		return false
+	}
+
+	return existing.version > version || (existing.tombstone() && existing.version == version)
+}
+
+// store replaces what the shard holds for a key keeping count of the tombstones, expiries and memory, called with the lock held
+// On a bounded node keys picked by the policies are evicted once the new value takes the node over budget,
+// a value larger than the whole budget is refused. Nothing changes when the value is not kept
+func (sh *shard) store(key string, value cacheData) error {
+	if maxBytes := sh.node.maxBytes; maxBytes > 0 && !value.tombstone() && value.size(key) > maxBytes {
+		return fmt.Errorf("%w: key %s takes %d bytes, %s holds %d", errTooLarge, key, value.size(key), sh.node.ID, maxBytes)
+	}
+
+	existing, found := sh.get(key)
+
+	if err := sh.entries.Set(key, value.entry()); err != nil {
+		logMessage(LOG_ERROR, sh.node.ID+" failed to store key: "+key+": "+err.Error())
+		return err
+	}
+
+	if found {
+		sh.account(key, existing, -1)
+	}
+	sh.account(key, value, 1)
+
+	if sh.node.maxBytes > 0 {
+		sh.track(key, existing, found, value)
+		sh.node.evict(sh)
+	}
+
+	return nil
+}
+
+// drop deletes what the shard holds for a key and stops tracking it for eviction, called with the lock held
+func (sh *shard) drop(key string) bool {
+	existing, found := sh.release(key)
+	if found && sh.node.maxBytes > 0 && !existing.tombstone() {
+		sh.policyOf(existing.copy).remove(key)
+	}
+
+	return found
+}
+
+// release deletes what the shard holds for a key along with its accounting and returns it, called with the lock held
+// A key the store fails to delete is kept and reported as not released
+func (sh *shard) release(key string) (cacheData, bool) {
+	existing, found := sh.get(key)
+	if !found {
+		return existing, false
+	}
+
+	if err := sh.entries.Delete(key); err != nil {
+		logMessage(LOG_ERROR, sh.node.ID+" failed to delete key: "+key+": "+err.Error())
+		return existing, false
+	}
+
+	sh.account(key, existing, -1)
+	return existing, true
+}
+
+// account adds a value stored under key to the counts of the shard, or takes it out when sign is negative
+func (sh *shard) account(key string, value cacheData, sign int) {
+	sh.keys += sign
+	sh.bytes += sign * value.size(key)
+	sh.node.bytes.Add(int64(sign * value.size(key)))
+
+	if value.tombstone() {
+		sh.tombstones += sign
+	}
+
+	if sign < 0 {
+		delete(sh.expiries, key)
+	} else if !value.expires.IsZero() {
+		sh.expiries[key] = value.expires
+	}
+}
@@ -0,0 +1,86 @@
+package vitarit
+
+import "sync/atomic"
+
+// Stats reports counters of the cache running in this process
+type Stats struct {
+	ReadConflicts uint64 // Reads where replicas held different values under the same version
+	ReadRepairs   uint64 // Copies rewritten because a read found them missing or stale
+	HintsStored   uint64 // Writes kept for owners that could not be reached
+	HintsReplayed uint64 // Kept writes delivered once their owner was seen again
+	HintsDropped  uint64 // Kept writes lost because the store was full or they expired
+	SyncRounds    uint64 // Anti-entropy rounds completed
+	SyncKeys      uint64 // Keys pushed or pulled by anti-entropy
+
+	TombstonesPurged uint64 // Tombstones of removed keys dropped after their grace period
+	Expired          uint64 // Keys reclaimed by the sweeper after their TTL passed
+	Hits             uint64 // Reads served by the local node which found the key
+	Misses           uint64 // Reads served by the local node which did not find the key
+	Evictions        uint64 // Keys dropped to keep the local node within its memory budget
+	EvictedBytes     uint64 // Bytes of keys and values dropped to keep the local node within its memory budget
+
+	RebalanceRounds  uint64 // Rebalances run after membership changes
+	RebalancePending uint64 // Local keys the running rebalance has yet to look at
+	RebalanceKeys    uint64 // Keys streamed to their new owners
+	RebalanceBytes   uint64 // Bytes of keys and values streamed to their new owners
+	RebalanceDropped uint64 // Local copies dropped because this node no longer owns them
+
+	HandoffKeys   uint64 // Copies handed to the next owners while leaving the ring
+	HandoffFailed uint64 // Copies the next owners did not acknowledge while leaving the ring
+}
+
+// cacheStats holds the live counters behind Stats
+type cacheStats struct {
+	readConflicts atomic.Uint64
+	readRepairs   atomic.Uint64
+	hintsStored   atomic.Uint64
+	hintsReplayed atomic.Uint64
+	hintsDropped  atomic.Uint64
+	syncRounds    atomic.Uint64
+	syncKeys      atomic.Uint64
+
+	tombstonesPurged atomic.Uint64
+	expired          atomic.Uint64
+	hits             atomic.Uint64
+	misses           atomic.Uint64
+	evictions        atomic.Uint64
+	evictedBytes     atomic.Uint64
+
+	rebalanceRounds  atomic.Uint64
+	rebalancePending atomic.Uint64
+	rebalanceKeys    atomic.Uint64
+	rebalanceBytes   atomic.Uint64
+	rebalanceDropped atomic.Uint64
+
+	handoffKeys   atomic.Uint64
+	handoffFailed atomic.Uint64
+}
+
+// snapshot copies the current counters
+func (stats *cacheStats) snapshot() Stats {
+	return Stats{
+		ReadConflicts: stats.readConflicts.Load(),
+		ReadRepairs:   stats.readRepairs.Load(),
+		HintsStored:   stats.hintsStored.Load(),
+		HintsReplayed: stats.hintsReplayed.Load(),
+		HintsDropped:  stats.hintsDropped.Load(),
+		SyncRounds:    stats.syncRounds.Load(),
+		SyncKeys:      stats.syncKeys.Load(),
+
+		TombstonesPurged: stats.tombstonesPurged.Load(),
+		Expired:          stats.expired.Load(),
+		Hits:             stats.hits.Load(),
+		Misses:           stats.misses.Load(),
+		Evictions:        stats.evictions.Load(),
+		EvictedBytes:     stats.evictedBytes.Load(),
+
+		RebalanceRounds:  stats.rebalanceRounds.Load(),
+		RebalancePending: stats.rebalancePending.Load(),
+		RebalanceKeys:    stats.rebalanceKeys.Load(),
+		RebalanceBytes:   stats.rebalanceBytes.Load(),
+		RebalanceDropped: stats.rebalanceDropped.Load(),
+
+		HandoffKeys:   stats.handoffKeys.Load(),
+		HandoffFailed: stats.handoffFailed.Load(),
+	}
+}
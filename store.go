@@ -0,0 +1,147 @@
+package vitarit
+
+import (
+	"strconv"
+	"time"
+)
+
+// Entry is what a Store holds for a key, a removed key is kept as a tombstone without a value
+type Entry struct {
+	Value   []byte    // Bytes of the value, nil on tombstones
+	Copy    int       // Copy of the key this node holds, 0 when it is the primary
+	Crc     uint32    // CRC32 checksum of the value
+	Version uint64    // Version of the write that stored the entry, a newer write has a higher version
+	Deleted time.Time // Set on tombstones, local time the key was removed
+	Expires time.Time // Entry is gone after this time, zero when it never expires
+}
+
+// Store keeps the keys of the node running in this process
+// A store passed with WithStore is used by every shard of the node, so it must be safe for concurrent use,
+// calls for the same key are never made concurrently. Entries already in the store are served once the node starts
+type Store interface {
+	Get(key string) (Entry, bool)                // Entry stored for the key, expired entries included
+	Set(key string, entry Entry) error           // Stores the entry, replacing what the key held
+	Delete(key string) error                     // Forgets the key, deleting a missing key is no error
+	Range(fn func(key string, entry Entry) bool) // Calls fn for every key until it returns false
+	Len() int                                    // Number of keys, tombstones included
+	Close() error                                // Releases the store once the node stopped
+}
+
+// -----------------------------------------------------------------------
+
+// entry converts cached data into what a store holds
+func (value cacheData) entry() Entry {
+	return Entry{
+		Value:   value.bytes,
+		Copy:    value.copy,
+		Crc:     value.crc,
+		Version: value.version,
+		Deleted: value.deleted,
+		Expires: value.expires,
+	}
+}
+
+// fromEntry converts what a store holds into cached data
+func fromEntry(entry Entry) cacheData {
+	return cacheData{
+		bytes:   entry.Value,
+		copy:    entry.Copy,
+		crc:     entry.Crc,
+		version: entry.Version,
+		deleted: entry.Deleted,
+		expires: entry.Expires,
+	}
+}
+
+// -----------------------------------------------------------------------
+
+// mapStore is the default store, an in-memory map per shard
+// It is not safe for concurrent use, the lock of the shard owning it guards it
+type mapStore map[string]Entry
+
+func (store mapStore) Get(key string) (Entry, bool) {
+	entry, found := store[key]
+	return entry, found
+}
+
+func (store mapStore) Set(key string, entry Entry) error {
+	store[key] = entry
+	return nil
+}
+
+func (store mapStore) Delete(key string) error {
+	delete(store, key)
+	return nil
+}
+
+func (store mapStore) Range(fn func(key string, entry Entry) bool) {
+	for key, entry := range store {
+		if !fn(key, entry) {
+			return
+		}
+	}
+}
+
+func (store mapStore) Len() int {
+	return len(store)
+}
+
+func (store mapStore) Close() error {
+	return nil
+}
+
+// -----------------------------------------------------------------------
+
+// attach makes every shard of the node use the given store and accounts for the entries it already holds
+// Called before the node serves requests, in place of the in-memory maps
+func (cnode *cacheNode) attach(store Store) {
+	for _, sh := range cnode.shards {
+		sh.reset(store)
+	}
+	cnode.shared = store
+
+	store.Range(func(key string, entry Entry) bool {
+		sh := cnode.shardOf(key)
+		sh.account(key, fromEntry(entry), 1)
+		return true
+	})
+
+	logMessage(LOG_INFO, cnode.ID+" attached store holding "+strconv.Itoa(store.Len())+" keys")
+}
+
+// scan calls fn for every key the node holds until it returns false
+// Shards with their own map are read under their lock one after the other, a shared store is read once without it
+func (cnode *cacheNode) scan(fn func(key string, value cacheData) bool) {
+	visit := func(key string, entry Entry) bool {
+		return fn(key, fromEntry(entry))
+	}
+
+	if cnode.shared != nil {
+		cnode.shared.Range(visit)
+		return
+	}
+
+	for _, sh := range cnode.shards {
+		sh.mtx.RLock()
+		more := true
+		sh.entries.Range(func(key string, entry Entry) bool {
+			more = visit(key, entry)
+			return more
+		})
+		sh.mtx.RUnlock()
+
+		if !more {
+			return
+		}
+	}
+}
+
+// closeStore releases the store of the node once it stopped serving requests, the in-memory maps need no release
+// Store is closed once even when the node is stopped again after leaving
+func (cnode *cacheNode) closeStore() error {
+	if cnode.shared == nil || !cnode.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	return cnode.shared.Close()
+}
@@ -1,35 +1,79 @@
 package vitarit
 
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// KeyLocation describes which nodes hold a key
+type KeyLocation struct {
+	Key      string     // Key that was located
+	Primary  nodeInfo   // Node owning the key, holds copy 0
+	Replicas []nodeInfo // Nodes holding redundant copies, in copy order
+}
+
+// NodeRingInfo describes what part of the hash space a node owns
+type NodeRingInfo struct {
+	Node      nodeInfo // Node this information belongs to
+	Positions []uint64 // Sorted positions of its virtual nodes, empty for placements not using the ring
+	Ownership float64  // Fraction of the hash space owned as primary, between 0 and 1
+}
+
+// Epoch identifies the membership a node routes keys with
+// Version only grows locally, nodes agree on the ring when their digests are equal
+type Epoch struct {
+	Version uint64 // Number of membership changes seen by this node
+	Digest  string // Digest of the IDs of all members and of the shares kept by those above the bounded load limit
+	Members int    // Number of members in the ring
+}
+
 // Vitarit struct
 type Vitarit struct {
-	node  nodeInfo          // Embedding nodeInfo struct to Vitarit struct
-	cache *distributedCache // Embedding distributedCache struct to Vitarit struct
+	node   nodeInfo          // Embedding nodeInfo struct to Vitarit struct
+	config config            // Tunables applied through options
+	cache  *distributedCache // Embedding distributedCache struct to Vitarit struct
 }
 
 // NewVitarit function to create a new Vitarit struct
-func NewVitarit(nodeId string, ip string, port string, groupID string) *Vitarit {
+func NewVitarit(nodeId string, ip string, port string, groupID string, opts ...Option) *Vitarit {
 	node := nodeInfo{
 		ID:      nodeId,
 		IP:      ip,
 		Port:    port,
 		GroupID: groupID,
+		Weight:  1,
+	}
+
+	v := &Vitarit{
+		node:   node,
+		config: defaultConfig(),
+		cache:  nil,
 	}
 
-	return &Vitarit{
-		node:  node,
-		cache: nil,
+	for _, opt := range opts {
+		opt(v)
 	}
+
+	// Advertise how keys are placed so peers placing them differently can refuse to join
+	v.node.VNodes = v.config.virtualNodes
+	v.node.Hasher = v.config.hasher.Name()
+	v.node.Placement = string(v.config.placement)
+	v.node.LoadFactor = v.config.loadFactor
+	v.node.HashTags = v.config.hashTags
+
+	return v
 }
 
 // SetLogger function to set the logger function
 func (v *Vitarit) SetLogger(f func(int, string)) {
-	logFunc = f
+	logFunc.Store(&f)
 }
 
 // Start this node and join the ring
 func (v *Vitarit) Start(redundancy int) {
 	// Create a new distribute cache object to add this node to the ring
-	v.cache = newDistributedCache(redundancy)
+	v.cache = newDistributedCache(redundancy, v.config)
 	v.cache.addNode(v.node)
 
 	// Start peer discovery using heartbeats
@@ -37,26 +81,131 @@ func (v *Vitarit) Start(redundancy int) {
 }
 
 // Stop the peer discovery and server of this node
+// Peers notice the node is gone once its heartbeats time out, keys held only here are lost
 func (v *Vitarit) Stop() {
 	v.cache.stop()
 }
 
+// Leave announces to peers that this node is leaving, hands its keys to their next owners and then stops
+// Handoff waits for every copy to be acknowledged, it fails with ErrHandoffTimeout when the timeout passes first
+// and with ErrHandoffFailed when a next owner did not acknowledge a copy, those keys are lost with this node
+func (v *Vitarit) Leave(timeout time.Duration) error {
+	return v.cache.leave(timeout)
+}
+
 // Get the value of key from the ring
-func (v *Vitarit) Get(key string) ([]byte, bool) {
-	return v.cache.get(key)
+// Options override the read consistency and timeout configured on this instance for this call only
+func (v *Vitarit) Get(key string, opts ...CallOption) ([]byte, bool) {
+	return v.cache.get(key, opts...)
+}
+
+// Set value of given key in the ring, fails when the write quorum was not reached
+// Options override the write quorum and timeout configured on this instance, or make the write async
+func (v *Vitarit) Set(key string, value []byte, opts ...CallOption) error {
+	return v.cache.set(key, value, opts...)
+}
+
+// SetWithTTL sets value of given key which expires after ttl on every node holding a copy
+func (v *Vitarit) SetWithTTL(key string, value []byte, ttl time.Duration, opts ...CallOption) error {
+	return v.cache.setWithTTL(key, value, ttl, opts...)
+}
+
+// TTL returns time left before the key expires, zero when it never expires, false when the key does not exist
+func (v *Vitarit) TTL(key string, opts ...CallOption) (time.Duration, bool) {
+	return v.cache.ttl(key, opts...)
+}
+
+// Touch sets the key to expire after ttl from now, zero ttl makes it never expire
+// Expiry is changed on the owner of the key and replicated, it fails with ErrNotFound when the key does not exist
+func (v *Vitarit) Touch(key string, ttl time.Duration, opts ...CallOption) error {
+	return v.cache.touch(key, ttl, opts...)
+}
+
+// GetWithVersion returns the value of a key along with its version, to be used with CompareAndSwap
+func (v *Vitarit) GetWithVersion(key string, opts ...CallOption) ([]byte, uint64, bool) {
+	data, found := v.cache.read(key, opts...)
+	if !found {
+		return []byte{}, 0, false
+	}
+
+	return data.bytes, data.version, true
+}
+
+// CompareAndSwap sets the key only when it is still at the expected version, 0 expects the key to be absent
+// It returns the new version, or ErrConflict when another write got there first
+// Check runs on the owner of the key, so it fails when the owner cannot be reached
+func (v *Vitarit) CompareAndSwap(key string, expectedVersion uint64, value []byte) (uint64, error) {
+	return v.cache.setIf(key, value, ifVersion(expectedVersion))
+}
+
+// SetIfAbsent sets the key only when it does not exist, fails with ErrConflict otherwise
+func (v *Vitarit) SetIfAbsent(key string, value []byte) error {
+	_, err := v.cache.setIf(key, value, ifAbsent)
+	return err
+}
+
+// SetIfPresent sets the key only when it exists, fails with ErrConflict otherwise
+func (v *Vitarit) SetIfPresent(key string, value []byte) error {
+	_, err := v.cache.setIf(key, value, ifPresent)
+	return err
+}
+
+// Incr adds delta to the decimal counter stored under key and returns the new value
+// Increment runs atomically on the owner of the key and is then replicated, a missing counter starts from 0
+// or the value given through WithInitialValue, it fails with ErrNotCounter when the key holds anything else
+func (v *Vitarit) Incr(key string, delta int64, opts ...CounterOption) (int64, error) {
+	return v.cache.incr(key, delta, opts...)
 }
 
-// Set value of given key in the ring
-func (v *Vitarit) Set(key string, value []byte) {
-	v.cache.set(key, value)
+// Decr subtracts delta from the decimal counter stored under key and returns the new value, see Incr
+func (v *Vitarit) Decr(key string, delta int64, opts ...CounterOption) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, fmt.Errorf("%w: cannot decrement by %d", ErrNotCounter, delta)
+	}
+
+	return v.cache.incr(key, -delta, opts...)
 }
 
-// Remove this key from the ring
-func (v *Vitarit) Remove(key string) {
-	v.cache.remove(key)
+// Remove this key from every node holding a copy, fails when the write quorum was not reached
+// Owners keep a tombstone of the key for the grace period so stale copies cannot bring it back
+func (v *Vitarit) Remove(key string, opts ...CallOption) error {
+	return v.cache.remove(key, opts...)
 }
 
 // Get Peers
 func (v *Vitarit) GetPeers() []nodeInfo {
 	return v.cache.getPeers()
 }
+
+// Locate returns the node owning this key and the nodes holding its replicas
+func (v *Vitarit) Locate(key string) KeyLocation {
+	location := KeyLocation{Key: key}
+
+	placement := v.cache.placementOf(key)
+	if len(placement) > 0 {
+		location.Primary = placement[0]
+		location.Replicas = placement[1:]
+	}
+
+	return location
+}
+
+// RingInfo returns ring positions of each node and the fraction of the hash space it owns
+func (v *Vitarit) RingInfo() []NodeRingInfo {
+	return v.cache.ringInfo()
+}
+
+// Epoch returns the membership epoch this node currently routes keys with
+func (v *Vitarit) Epoch() Epoch {
+	return v.cache.epoch()
+}
+
+// Stats returns counters of the cache running in this node
+func (v *Vitarit) Stats() Stats {
+	return v.cache.stats.snapshot()
+}
+
+// AntiEntropy compares the keys this node shares with every peer and repairs the copies that differ
+func (v *Vitarit) AntiEntropy() error {
+	return v.cache.antiEntropy()
+}
@@ -1,9 +1,22 @@
 package vitarit
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -218,3 +231,2249 @@ func TestRedundancy(t *testing.T) {
 		t.Logf("key1 not found")
 	}
 }
+
+func TestVirtualNodeDistribution(t *testing.T) {
+	ring := NewHashRing(config{virtualNodes: 100})
+	ring.addNode(nodeInfo{ID: "node1", Weight: 1})
+	ring.addNode(nodeInfo{ID: "node2", Weight: 1})
+	ring.addNode(nodeInfo{ID: "node3", Weight: 2})
+
+	counts := make(map[string]int)
+	for i := 0; i < 40000; i++ {
+		counts[ring.getNode(fmt.Sprintf("user:%d", i)).ID]++
+	}
+	t.Logf("Key distribution: %v", counts)
+
+	// node3 has double the weight so it should own about half of the keys
+	if counts["node3"] < 15000 || counts["node3"] > 25000 {
+		t.Errorf("node3 owns %d keys, expected close to 20000", counts["node3"])
+	}
+
+	for _, id := range []string{"node1", "node2"} {
+		if counts[id] < 6000 || counts[id] > 14000 {
+			t.Errorf("%s owns %d keys, expected close to 10000", id, counts[id])
+		}
+	}
+}
+
+func TestReplicasOnDistinctNodes(t *testing.T) {
+	ring := NewHashRing(config{virtualNodes: 50})
+	ring.addNode(nodeInfo{ID: "node1"})
+	ring.addNode(nodeInfo{ID: "node2"})
+	ring.addNode(nodeInfo{ID: "node3"})
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		nodes := ring.getNodes(key, 2)
+		if len(nodes) != 3 {
+			t.Fatalf("expected 3 nodes for %s, got %d", key, len(nodes))
+		}
+
+		if nodes[0] != ring.getNode(key) {
+			t.Errorf("first node for %s is not the owner", key)
+		}
+
+		if nodes[0].ID == nodes[1].ID || nodes[1].ID == nodes[2].ID || nodes[0].ID == nodes[2].ID {
+			t.Errorf("replicas of %s share a node: %s %s %s", key, nodes[0].ID, nodes[1].ID, nodes[2].ID)
+		}
+	}
+
+	// Asking for more copies than nodes returns each node once
+	if nodes := ring.getNodes("key", 5); len(nodes) != 3 {
+		t.Errorf("expected 3 nodes, got %d", len(nodes))
+	}
+
+	ring.removeNode("node2")
+	if len(ring.sortedHashes) != 100 || len(ring.nodes) != 2 {
+		t.Errorf("ring not cleaned after remove: %d hashes, %d nodes", len(ring.sortedHashes), len(ring.nodes))
+	}
+}
+
+func TestHashers(t *testing.T) {
+	// Reference values of xxHash64 with seed 0
+	vectors := map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	}
+
+	for input, expected := range vectors {
+		if sum := XXHash64.Sum64([]byte(input)); sum != expected {
+			t.Errorf("xxhash64(%q) = %x, expected %x", input, sum, expected)
+		}
+	}
+
+	if sum := FNV1a64Hasher.Sum64([]byte("a")); sum != 0xaf63dc4c8601ec8c {
+		t.Errorf("fnv1a64(a) = %x", sum)
+	}
+
+	for _, hasher := range []Hasher{CRC32Hasher, FNV1a64Hasher, XXHash64} {
+		ring := NewHashRing(config{virtualNodes: 100, hasher: hasher})
+		ring.addNode(nodeInfo{ID: "node1"})
+		ring.addNode(nodeInfo{ID: "node2"})
+		ring.addNode(nodeInfo{ID: "node3"})
+
+		counts := make(map[string]int)
+		for i := 0; i < 30000; i++ {
+			counts[ring.getNode(fmt.Sprintf("user:%d", i)).ID]++
+		}
+		t.Logf("Key distribution with %s: %v", hasher.Name(), counts)
+	}
+}
+
+func TestHasherMismatch(t *testing.T) {
+	me := NewVitarit("node1", "127.0.0.1", "8081", "A", WithHasher(XXHash64)).node
+
+	if err := checkCompatible(me, nodeInfo{ID: "node2", Hasher: "xxhash64"}); err != nil {
+		t.Errorf("same hasher rejected: %v", err)
+	}
+
+	if err := checkCompatible(me, nodeInfo{ID: "node2", Hasher: "fnv1a64"}); err == nil {
+		t.Errorf("different hasher accepted")
+	}
+
+	// Older peers do not advertise a hasher, they always used crc32
+	if err := checkCompatible(me, nodeInfo{ID: "node2"}); err == nil {
+		t.Errorf("peer without hasher accepted by xxhash64 node")
+	}
+
+	legacy := NewVitarit("node3", "127.0.0.1", "8083", "A").node
+	if err := checkCompatible(legacy, nodeInfo{ID: "node2"}); err != nil {
+		t.Errorf("peer without hasher rejected by crc32 node: %v", err)
+	}
+}
+
+func TestVirtualNodesMismatch(t *testing.T) {
+	me := NewVitarit("node1", "127.0.0.1", "8081", "A", WithVirtualNodes(10)).node
+
+	if err := checkCompatible(me, nodeInfo{ID: "node2", VNodes: 10}); err != nil {
+		t.Errorf("same virtual node count rejected: %v", err)
+	}
+
+	if err := checkCompatible(me, nodeInfo{ID: "node2", VNodes: 20}); err == nil {
+		t.Errorf("different virtual node count accepted")
+	}
+
+	// Older peers do not advertise a count, they always placed one point per node
+	if err := checkCompatible(me, nodeInfo{ID: "node2"}); err == nil {
+		t.Errorf("peer without virtual node count accepted by node placing 10")
+	}
+
+	legacy := NewVitarit("node3", "127.0.0.1", "8083", "A").node
+	if err := checkCompatible(legacy, nodeInfo{ID: "node2"}); err != nil {
+		t.Errorf("peer without virtual node count rejected by default node: %v", err)
+	}
+}
+
+func TestPlacementStrategies(t *testing.T) {
+	for _, placement := range []Placement{PlacementRing, PlacementRendezvous, PlacementJump} {
+		ring := NewHashRing(config{virtualNodes: 50, hasher: XXHash64, placement: placement})
+		for i := 1; i <= 5; i++ {
+			ring.addNode(nodeInfo{ID: fmt.Sprintf("node%d", i)})
+		}
+
+		before := make(map[string]string)
+		counts := make(map[string]int)
+		for i := 0; i < 10000; i++ {
+			key := fmt.Sprintf("user:%d", i)
+			nodes := ring.getNodes(key, 2)
+			if len(nodes) != 3 || nodes[0] != ring.getNode(key) {
+				t.Fatalf("%s: bad owners for %s", placement, key)
+			}
+
+			if nodes[0].ID == nodes[1].ID || nodes[1].ID == nodes[2].ID || nodes[0].ID == nodes[2].ID {
+				t.Errorf("%s: replicas of %s share a node", placement, key)
+			}
+
+			before[key] = nodes[0].ID
+			counts[nodes[0].ID]++
+		}
+		t.Logf("Key distribution with %s: %v", placement, counts)
+
+		// Dropping a node from the middle must only move the keys it owned, except with jump hash
+		// which renumbers every bucket after it
+		moved := movedOwners(ring, before, "node3")
+		switch {
+		case placement != PlacementJump && moved != 0:
+			t.Errorf("%s: %d keys moved between surviving nodes", placement, moved)
+		case placement == PlacementJump && moved < len(before)/4:
+			t.Errorf("%s: only %d keys moved between surviving nodes after removing a middle bucket", placement, moved)
+		}
+		t.Logf("%s: %d keys of surviving nodes moved", placement, moved)
+
+		// Dropping the node with the highest ID keeps every other key in place with all placements
+		for key := range before {
+			before[key] = ring.getNode(key).ID
+		}
+
+		if moved := movedOwners(ring, before, "node5"); moved != 0 {
+			t.Errorf("%s: %d keys moved between surviving nodes after removing the last node", placement, moved)
+		}
+	}
+}
+
+func TestRendezvousDistribution(t *testing.T) {
+	// Default hasher is 32 bits wide, scores must not depend on its width
+	ring := NewHashRing(config{placement: PlacementRendezvous})
+	ring.addNode(nodeInfo{ID: "node1", Weight: 1})
+	ring.addNode(nodeInfo{ID: "node2", Weight: 1})
+	ring.addNode(nodeInfo{ID: "node3", Weight: 2})
+
+	counts := make(map[string]int)
+	for i := 0; i < 40000; i++ {
+		counts[ring.getNode(fmt.Sprintf("user:%d", i)).ID]++
+	}
+	t.Logf("Key distribution: %v", counts)
+
+	// node3 has double the weight so it should own about half of the keys
+	if counts["node3"] < 18000 || counts["node3"] > 22000 {
+		t.Errorf("node3 owns %d keys, expected close to 20000", counts["node3"])
+	}
+
+	for _, id := range []string{"node1", "node2"} {
+		if counts[id] < 9000 || counts[id] > 11000 {
+			t.Errorf("%s owns %d keys, expected close to 10000", id, counts[id])
+		}
+	}
+
+	// With equal weights every node owns a fifth of the keys and replicates to every other node
+	ring = NewHashRing(config{placement: PlacementRendezvous})
+	for i := 1; i <= 5; i++ {
+		ring.addNode(nodeInfo{ID: fmt.Sprintf("node%d", i)})
+	}
+
+	counts = make(map[string]int)
+	pairs := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		nodes := ring.getNodes(fmt.Sprintf("user:%d", i), 1)
+		counts[nodes[0].ID]++
+		pairs[nodes[0].ID+">"+nodes[1].ID]++
+	}
+	t.Logf("Key distribution: %v", counts)
+
+	for id, count := range counts {
+		if count < 5400 || count > 6600 {
+			t.Errorf("%s owns %d keys, expected close to 6000", id, count)
+		}
+	}
+
+	if len(pairs) != 20 {
+		t.Errorf("%d of 20 owner and replica pairs used: %v", len(pairs), pairs)
+	}
+}
+
+// movedOwners removes a node and counts the keys whose owner changed although it survived
+func movedOwners(ring *hashRing, before map[string]string, removed string) int {
+	ring.removeNode(removed)
+
+	moved := 0
+	for key, owner := range before {
+		if owner != removed && ring.getNode(key).ID != owner {
+			moved++
+		}
+	}
+
+	return moved
+}
+
+func TestBoundedLoad(t *testing.T) {
+	ring := NewHashRing(config{virtualNodes: 20, hasher: XXHash64, loadFactor: 0.25})
+	for i := 1; i <= 4; i++ {
+		ring.addNode(nodeInfo{ID: fmt.Sprintf("node%d", i)})
+	}
+
+	// Find keys of the node about to become the hottest one
+	owner := ring.getNode("hot:key")
+	keys := []string{}
+	for i := 0; i < 2000; i++ {
+		if key := fmt.Sprintf("key%d", i); ring.getNode(key) == owner {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, cnode := range ring.nodes {
+		load := 100
+		if cnode == owner {
+			load = 200
+		}
+		ring.setLoad(cnode.ID, load, nil)
+	}
+
+	// Limit is 1.25 times the average of 125 keys, the owner keeps 156 of its 200 keys
+	share := ring.shares[owner.ID]
+	if share != 50 {
+		t.Fatalf("%s keeps %d of %d slots, expected 50", owner.ID, share, keepSlots)
+	}
+
+	kept := 0
+	for _, key := range keys {
+		nodes := ring.getNodes(key, 1)
+		if keepSlot(key) < share {
+			kept++
+			if nodes[0] != owner {
+				t.Errorf("%s moved to %s although %s keeps it", key, nodes[0].ID, owner.ID)
+			}
+		} else if nodes[0] == owner || nodes[1] == owner {
+			t.Errorf("overloaded owner %s still picked for %s", owner.ID, key)
+		}
+	}
+
+	// Only the keys over the limit overflow
+	if kept == 0 || kept == len(keys) {
+		t.Errorf("%s kept %d of %d keys", owner.ID, kept, len(keys))
+	}
+
+	// Once the loads even out the keys go back to their owner
+	ring.setLoad(owner.ID, 100, nil)
+	for _, key := range keys {
+		if cnode := ring.getNode(key); cnode != owner {
+			t.Errorf("%s moved to %s although %s is no longer full", key, cnode.ID, owner.ID)
+		}
+	}
+}
+
+func TestBoundedLoadSettles(t *testing.T) {
+	ring := NewHashRing(config{virtualNodes: 10, loadFactor: 0.1})
+	for i := 1; i <= 3; i++ {
+		ring.addNode(nodeInfo{ID: fmt.Sprintf("node%d", i)})
+	}
+
+	keys := make([]string, 3000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+
+	// place returns owner of every key, then advertises the load each owner counts from the keys it holds
+	place := func() map[string]string {
+		owners := make(map[string]string, len(keys))
+		held := make(map[string][]string)
+		for _, key := range keys {
+			id := ring.getNode(key).ID
+			owners[key] = id
+			held[id] = append(held[id], key)
+		}
+
+		for _, info := range ring.members() {
+			load, overflow := ring.ownedLoad(info.ID, held[info.ID])
+			ring.setLoad(info.ID, load, overflow)
+		}
+
+		return owners
+	}
+
+	before := place()
+	for round := 1; round <= 5; round++ {
+		owners := place()
+
+		moved := 0
+		for key, id := range owners {
+			if before[key] != id {
+				moved++
+			}
+		}
+
+		// Keys overflow once, after that the loads fed back must not move them again
+		if round == 1 && moved == 0 {
+			t.Fatalf("no key overflowed, shares %v", ring.shares)
+		}
+		if round > 1 && moved != 0 {
+			t.Errorf("round %d moved %d keys, shares %v", round, moved, ring.shares)
+		}
+
+		before = owners
+	}
+
+	// Full nodes keep the keys up to their limit, they are not emptied
+	held := make(map[string]int)
+	for _, id := range before {
+		held[id]++
+	}
+
+	demand := ring.demand()
+	for id := range ring.shares {
+		if held[id] == 0 || held[id] >= demand[id] {
+			t.Errorf("full node %s holds %d keys of a demand of %d", id, held[id], demand[id])
+		}
+	}
+	t.Logf("held %v demand %v shares %v", held, demand, ring.shares)
+}
+
+func TestBoundedLoadMovesKeys(t *testing.T) {
+	cluster := newTestCluster(t, 3, 0, config{virtualNodes: 10, hasher: XXHash64, loadFactor: 0.25})
+
+	// Key in the last slot overflows whatever share its full owner keeps
+	key := "hot:key"
+	for i := 0; keepSlot(key) != keepSlots-1; i++ {
+		key = fmt.Sprintf("hot:key%d", i)
+	}
+
+	if err := cluster.caches[0].set(key, []byte("before")); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	owner := cluster.caches[0].getNode(key).ID
+
+	// setLoads advertises the loads on every node and runs the rebalance the change scheduled right away
+	setLoads := func(hot int) {
+		for i, cache := range cluster.caches {
+			cache.mtx.Lock()
+			for _, info := range cache.hashRing.members() {
+				load := 100
+				if info.ID == owner {
+					load = hot
+				}
+				cache.refreshLoad_unlocked(info.ID, load, nil)
+			}
+			cache.mtx.Unlock()
+
+			cache.rebalanceMtx.Lock()
+			from := cache.rebalanceFrom
+			if cache.rebalanceTimer != nil {
+				cache.rebalanceTimer.Stop()
+			}
+			cache.rebalanceFrom, cache.rebalanceTimer = nil, nil
+			cache.rebalanceMtx.Unlock()
+
+			if from == nil {
+				t.Fatalf("node%d scheduled no rebalance when %s load became %d", i+1, owner, hot)
+			}
+			cache.rebalance(from, cache.hashRing.snapshot())
+		}
+	}
+
+	digest := cluster.caches[0].epoch().Digest
+	setLoads(200)
+
+	if cluster.caches[0].epoch().Digest == digest {
+		t.Errorf("epoch did not change when %s became full", owner)
+	}
+
+	overflow := cluster.caches[0].getNode(key).ID
+	if overflow == owner {
+		t.Fatalf("%s still owned by full node %s", key, owner)
+	}
+
+	if value, found := cluster.caches[1].get(key); !found || string(value) != "before" {
+		t.Errorf("%s not found on overflow node %s: %v %q", key, overflow, found, value)
+	}
+
+	// Write made while the owner is full must survive the key moving back
+	if err := cluster.caches[2].set(key, []byte("during")); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	setLoads(100)
+	if cnode := cluster.caches[0].getNode(key); cnode.ID != owner {
+		t.Fatalf("%s did not go back to %s", key, owner)
+	}
+
+	if value, found := cluster.caches[1].get(key); !found || string(value) != "during" {
+		t.Errorf("write made during the overflow lost: %v %q", found, value)
+	}
+
+	if _, found := cluster.local(cluster.byID(overflow)).get(key); found {
+		t.Errorf("overflow node %s still holds %s", overflow, key)
+	}
+}
+
+func TestLoadFactorMismatch(t *testing.T) {
+	me := NewVitarit("node1", "127.0.0.1", "8081", "A", WithBoundedLoad(0.25)).node
+
+	if err := checkCompatible(me, nodeInfo{ID: "node2", VNodes: 1, LoadFactor: 0.25}); err != nil {
+		t.Errorf("same load factor rejected: %v", err)
+	}
+
+	if err := checkCompatible(me, nodeInfo{ID: "node2", VNodes: 1, LoadFactor: 0.5}); err == nil {
+		t.Errorf("different load factor accepted")
+	}
+
+	// Older peers do not advertise a factor, they never bounded loads
+	if err := checkCompatible(me, nodeInfo{ID: "node2", VNodes: 1}); err == nil {
+		t.Errorf("peer without load factor accepted by bounded node")
+	}
+}
+
+func TestZoneAwarePlacement(t *testing.T) {
+	cache := newDistributedCache(2, config{virtualNodes: 20, hasher: XXHash64})
+
+	// Two nodes per zone, in zone a the nodes also share a rack
+	cache.addNode(nodeInfo{ID: "node1", Zone: "a", Rack: "r1"})
+	cache.addNode(nodeInfo{ID: "node2", Zone: "a", Rack: "r1"})
+	cache.addNode(nodeInfo{ID: "node3", Zone: "b", Rack: "r1"})
+	cache.addNode(nodeInfo{ID: "node4", Zone: "b", Rack: "r2"})
+	cache.addNode(nodeInfo{ID: "node5", Zone: "c", Rack: "r1"})
+	cache.addNode(nodeInfo{ID: "node6", Zone: "c", Rack: "r2"})
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		placement := cache.placementOf(key)
+		if len(placement) != 3 {
+			t.Fatalf("expected 3 copies of %s, got %d", key, len(placement))
+		}
+
+		if placement[0].ID != cache.getNode(key).ID {
+			t.Errorf("owner of %s is not the first copy", key)
+		}
+
+		zones := map[string]bool{}
+		for _, node := range placement {
+			zones[node.Zone] = true
+		}
+
+		if len(zones) != 3 {
+			t.Errorf("copies of %s are not spread across zones: %v", key, placement)
+		}
+	}
+
+	// With more copies than zones the extra copy goes to a rack not used yet
+	cache.redundancy = 3
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		racks := map[string]bool{}
+		for _, node := range cache.placementOf(key) {
+			racks[node.Zone+node.Rack] = true
+		}
+
+		if len(racks) != 4 {
+			t.Errorf("copies of %s reuse a rack", key)
+		}
+	}
+}
+
+func TestLocateAndRingInfo(t *testing.T) {
+	for _, placement := range []Placement{PlacementRing, PlacementRendezvous, PlacementJump} {
+		vitarit := NewVitarit("node1", "127.0.0.1", "8081", "A", WithVirtualNodes(10), WithPlacement(placement))
+
+		// Build the ring without starting discovery or the server
+		vitarit.cache = newDistributedCache(1, vitarit.config)
+		vitarit.cache.addNode(vitarit.node)
+		vitarit.cache.addNode(nodeInfo{ID: "node2", Weight: 1})
+		vitarit.cache.addNode(nodeInfo{ID: "node3", Weight: 2})
+
+		location := vitarit.Locate("user:42")
+		if location.Primary.ID != vitarit.cache.getNode("user:42").ID || len(location.Replicas) != 1 {
+			t.Errorf("%s: bad location %v", placement, location)
+		}
+
+		if location.Replicas[0].ID == location.Primary.ID {
+			t.Errorf("%s: replica on the primary node", placement)
+		}
+
+		total := 0.0
+		for _, info := range vitarit.RingInfo() {
+			total += info.Ownership
+			t.Logf("%s: %s owns %.3f with %d positions", placement, info.Node.ID, info.Ownership, len(info.Positions))
+
+			if placement == PlacementRing && len(info.Positions) != 10*max(info.Node.Weight, 1) {
+				t.Errorf("%s has %d positions", info.Node.ID, len(info.Positions))
+			}
+
+			if placement != PlacementRing && len(info.Positions) != 0 {
+				t.Errorf("%s: %s reports ring positions", placement, info.Node.ID)
+			}
+		}
+
+		if total < 0.999 || total > 1.001 {
+			t.Errorf("%s: ownership adds up to %f", placement, total)
+		}
+	}
+}
+
+func TestHashTags(t *testing.T) {
+	tags := map[string]string{
+		"order:{42}:items": "42",
+		"{user}:profile":   "user",
+		"plain":            "plain",
+		"empty:{}:tag":     "empty:{}:tag",
+		"open:{42":         "open:{42",
+		"two:{a}:{b}":      "a",
+		"nested:{{a}}":     "{a",
+	}
+
+	for key, expected := range tags {
+		if tag := hashTag(key); tag != expected {
+			t.Errorf("hashTag(%q) = %q, expected %q", key, tag, expected)
+		}
+	}
+
+	tagged := NewHashRing(config{virtualNodes: 20, hasher: XXHash64, hashTags: true})
+	plain := NewHashRing(config{virtualNodes: 20, hasher: XXHash64})
+	for i := 1; i <= 5; i++ {
+		tagged.addNode(nodeInfo{ID: fmt.Sprintf("node%d", i)})
+		plain.addNode(nodeInfo{ID: fmt.Sprintf("node%d", i)})
+	}
+
+	split := false
+	for i := 0; i < 100; i++ {
+		items := fmt.Sprintf("order:{%d}:items", i)
+		status := fmt.Sprintf("order:{%d}:status", i)
+
+		if tagged.getNode(items) != tagged.getNode(status) {
+			t.Errorf("%s and %s are on different nodes", items, status)
+		}
+
+		if plain.getNode(items).ID != plain.getNode(status).ID {
+			split = true
+		}
+	}
+
+	// Without the option the braces are part of the hashed key
+	if !split {
+		t.Errorf("keys are co-located although hash tags are disabled")
+	}
+}
+
+func TestMembershipEpoch(t *testing.T) {
+	cache1 := newDistributedCache(0, config{virtualNodes: 10})
+	cache2 := newDistributedCache(0, config{virtualNodes: 10})
+
+	cache1.addNode(nodeInfo{ID: "node1"})
+	cache1.addNode(nodeInfo{ID: "node2"})
+	cache2.addNode(nodeInfo{ID: "node2"})
+	cache2.addNode(nodeInfo{ID: "node1"})
+
+	if cache1.epoch().Digest != cache2.epoch().Digest {
+		t.Errorf("same members give different digests")
+	}
+
+	// Heartbeats of known nodes do not change the epoch
+	before := cache1.epoch()
+	cache1.addNode(nodeInfo{ID: "node2"})
+	if cache1.epoch() != before {
+		t.Errorf("heartbeat changed epoch from %v to %v", before, cache1.epoch())
+	}
+
+	cache1.addNode(nodeInfo{ID: "node3"})
+	if cache1.epoch().Version <= before.Version || cache1.epoch().Digest == cache2.epoch().Digest {
+		t.Errorf("join did not move the epoch: %v", cache1.epoch())
+	}
+
+	// node1 sees node3 while the caller does not, requests for keys node1 no longer owns are redirected
+	cnode := cache1.getNodeByID("node1")
+	cnode.cache = cache1
+	cnode.set("local", 0, []byte{1}, newVersion())
+
+	redirected := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := cache1.getNode(key).ID
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, createURL(cnode, key, cache2.epoch().Digest), nil)
+		cnode.ServeHTTP(w, r)
+
+		if w.Header().Get(epochHeader) != cache1.epoch().Digest {
+			t.Errorf("response does not carry the epoch of node1")
+		}
+
+		if owner == "node1" {
+			if w.Code == http.StatusMisdirectedRequest {
+				t.Errorf("%s redirected although node1 owns it", key)
+			}
+			continue
+		}
+
+		redirected++
+		if w.Code != http.StatusMisdirectedRequest || w.Header().Get(ownersHeader) != owner {
+			t.Errorf("%s: expected redirect to %s, got %d %s", key, owner, w.Code, w.Header().Get(ownersHeader))
+		}
+	}
+
+	if redirected == 0 {
+		t.Errorf("no key was redirected")
+	}
+
+	// Requests routed with the same ring are always served
+	w := httptest.NewRecorder()
+	cnode.ServeHTTP(w, httptest.NewRequest(http.MethodGet, createURL(cnode, "local", cache1.epoch().Digest), nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("request with matching epoch got %d", w.Code)
+	}
+}
+
+// testCluster is a set of caches talking to each other over local TLS servers, without peer discovery
+type testCluster struct {
+	caches  []*distributedCache
+	servers []*httptest.Server
+}
+
+func newTestCluster(t *testing.T, count int, redundancy int, cfg config) *testCluster {
+	// Logger of an earlier test must not outlive it, goroutines of this cluster keep running after the test
+	logFunc.Store(nil)
+
+	cluster := &testCluster{}
+	handlers := make([]http.Handler, count)
+	nodes := make([]nodeInfo, count)
+
+	for i := 0; i < count; i++ {
+		idx := i
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[idx].ServeHTTP(w, r)
+		}))
+		cluster.servers = append(cluster.servers, srv)
+
+		host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		nodes[i] = nodeInfo{ID: fmt.Sprintf("node%d", i+1), IP: host, Port: port}
+	}
+
+	for i := 0; i < count; i++ {
+		cache := newDistributedCache(redundancy, cfg)
+		for _, node := range nodes {
+			cache.addNode(node)
+		}
+
+		local := cache.getNodeByID(nodes[i].ID)
+		local.cache = cache
+		cache.local = local
+		local.split(cfg.shards)
+		local.bound(cfg.maxBytes, cfg.eviction)
+		handlers[i] = local.handler()
+		cluster.caches = append(cluster.caches, cache)
+	}
+
+	t.Cleanup(cluster.close)
+	return cluster
+}
+
+// local returns the node of cache i holding its data
+func (cluster *testCluster) local(i int) *cacheNode {
+	return cluster.caches[i].getNodeByID(fmt.Sprintf("node%d", i+1))
+}
+
+// byID returns index of the node with given ID
+func (cluster *testCluster) byID(id string) int {
+	var idx int
+	fmt.Sscanf(id, "node%d", &idx)
+	return idx - 1
+}
+
+// waitFor polls cond until it holds or two seconds passed, copies beyond the write quorum arrive in the background
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// silentPeer returns port of a TLS server which accepts requests and never answers them while the test runs
+func silentPeer(t *testing.T) string {
+	release := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	return port
+}
+
+func (cluster *testCluster) close() {
+	for _, srv := range cluster.servers {
+		srv.Close()
+	}
+}
+
+func TestSetReplicates(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10})
+	cache := cluster.caches[0]
+
+	if err := cache.set("key1", []byte("value1")); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	// set returns on the first acknowledgement, the other copies arrive in the background
+	waitFor(func() bool {
+		for _, node := range cache.getNodes("key1", 2) {
+			if _, found := cluster.local(cluster.byID(node.ID)).get("key1"); !found {
+				return false
+			}
+		}
+		return true
+	})
+
+	for copy, node := range cache.getNodes("key1", 2) {
+		sh := cluster.local(cluster.byID(node.ID)).shardOf("key1")
+		sh.mtx.RLock()
+		data, found := sh.get("key1")
+		sh.mtx.RUnlock()
+
+		if !found || string(data.bytes) != "value1" || data.copy != copy {
+			t.Errorf("%s: expected copy %d of key1, got %v %v", node.ID, copy, found, data)
+		}
+	}
+
+	// Take down a replica, all copies can no longer acknowledge
+	replica := cache.getNodes("key2", 2)[2]
+	cluster.servers[cluster.byID(replica.ID)].Close()
+
+	cache.config.writeQuorum = 3
+	if err := cache.set("key2", []byte("value2")); !errors.Is(err, ErrWriteQuorum) {
+		t.Errorf("expected write quorum error, got %v", err)
+	}
+
+	cache.config.writeQuorum = 2
+	if err := cache.set("key2", []byte("value2")); err != nil {
+		t.Errorf("set with quorum 2 failed: %v", err)
+	}
+}
+
+func TestQuorumRead(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10, consistency: ConsistencyQuorum})
+	cache := cluster.caches[0]
+	nodes := cache.getNodes("key1", 2)
+
+	// Owner holds a stale copy, both replicas the newer one
+	cluster.local(cluster.byID(nodes[0].ID)).set("key1", 0, []byte("old"), 1)
+	cluster.local(cluster.byID(nodes[1].ID)).set("key1", 1, []byte("new"), 2)
+	cluster.local(cluster.byID(nodes[2].ID)).set("key1", 2, []byte("new"), 2)
+
+	value, found := cache.get("key1")
+	if !found || string(value) != "new" {
+		t.Errorf("quorum read returned %q %v, expected new", value, found)
+	}
+
+	// A stale write does not replace a newer version
+	cluster.local(cluster.byID(nodes[1].ID)).set("key1", 1, []byte("older"), 1)
+	if data, _ := cluster.local(cluster.byID(nodes[1].ID)).get("key1"); string(data.bytes) != "new" {
+		t.Errorf("stale write replaced the value with %q", data.bytes)
+	}
+
+	// Same version with different content is reported as a conflict, once repair of the stale owner is done
+	waitFor(func() bool {
+		return cache.stats.snapshot().ReadRepairs > 0
+	})
+	cache.config.consistency = ConsistencyAll
+	cluster.local(cluster.byID(nodes[0].ID)).set("key1", 0, []byte("other"), 2)
+	if _, found := cache.get("key1"); !found {
+		t.Errorf("key1 not found with consistency all")
+	}
+
+	if cache.stats.snapshot().ReadConflicts == 0 {
+		t.Errorf("conflict between copies not reported")
+	}
+
+	// All copies must answer, with one node down the read fails
+	cluster.servers[cluster.byID(nodes[2].ID)].Close()
+	if _, found := cache.get("key1"); found {
+		t.Errorf("read with consistency all succeeded with a node down")
+	}
+
+	cache.config.consistency = ConsistencyQuorum
+	if _, found := cache.get("key1"); !found {
+		t.Errorf("quorum read failed with one node down")
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10, consistency: ConsistencyAll})
+	cache := cluster.caches[0]
+	nodes := cache.getNodes("key1", 2)
+
+	// First replica is stale and the second lost the key
+	cluster.local(cluster.byID(nodes[0].ID)).set("key1", 0, []byte("new"), 2)
+	cluster.local(cluster.byID(nodes[1].ID)).set("key1", 1, []byte("old"), 1)
+
+	if value, found := cache.get("key1"); !found || string(value) != "new" {
+		t.Fatalf("read returned %q %v", value, found)
+	}
+
+	// Repair runs in the background
+	waitFor(func() bool {
+		return cache.stats.snapshot().ReadRepairs >= 2
+	})
+
+	if repairs := cache.stats.snapshot().ReadRepairs; repairs != 2 {
+		t.Errorf("expected 2 repairs, got %d", repairs)
+	}
+
+	for copy, node := range nodes {
+		data, found := cluster.local(cluster.byID(node.ID)).get("key1")
+		if !found || string(data.bytes) != "new" || data.version != 2 || data.copy != copy {
+			t.Errorf("%s not repaired: %v %v", node.ID, found, data)
+		}
+	}
+
+	// Copies in agreement need no repair, run it in the foreground to check nothing was sent
+	replies := cache.readReplicas(context.Background(), "key1", nodes, len(nodes))
+	newest, _ := cache.reconcile("key1", replies)
+	cache.readRepair("key1", newest, replies)
+	if repairs := cache.stats.snapshot().ReadRepairs; repairs != 2 {
+		t.Errorf("consistent copies were repaired, %d repairs", repairs)
+	}
+}
+
+func TestReadRepairSilentPeer(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10, timeout: 100 * time.Millisecond})
+	cache := cluster.caches[0]
+	nodes := cache.getNodes("key1", 2)
+
+	newest := replicaRead{node: nodes[0], found: true, data: cacheData{bytes: []byte("new"), version: 2}}
+	replies := []replicaRead{newest, {node: nodes[1], copy: 1}}
+
+	// Replica missing the key accepts the repair and never answers
+	nodes[1].Port = silentPeer(t)
+
+	start := time.Now()
+	cache.readRepair("key1", newest, replies)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("repair took %v with a silent peer", elapsed)
+	}
+
+	if repairs := cache.stats.snapshot().ReadRepairs; repairs != 0 {
+		t.Errorf("unanswered repair counted, %d repairs", repairs)
+	}
+}
+
+func TestSetSilentReplica(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10, timeout: 100 * time.Millisecond, hintBytes: 1024, hintTTL: time.Minute})
+	cache := cluster.caches[0]
+	nodes := cache.getNodes("key1", 2)
+
+	// Last replica accepts the copy and never answers
+	nodes[2].Port = silentPeer(t)
+
+	data := cacheData{bytes: []byte("value1"), crc: crc32.ChecksumIEEE([]byte("value1")), version: newVersion()}
+	if err := cache.replicate("key1", nodes, data, 0, callOptions{writeQuorum: 2}); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	// Copy written after the quorum gives up without a call timeout and is kept as a hint
+	if !waitFor(func() bool { return cache.hints.pending(nodes[2].ID) }) {
+		t.Errorf("copy to silent replica %s still in flight", nodes[2].ID)
+	}
+}
+
+func TestAsyncWriteSilentOwner(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10, timeout: 100 * time.Millisecond, hintBytes: 1024, hintTTL: time.Minute})
+	cache := cluster.caches[0]
+	nodes := cache.getNodes("key1", 2)
+
+	// Owner accepts every request and never answers
+	nodes[0].Port = silentPeer(t)
+
+	data := cacheData{bytes: []byte("value1"), crc: crc32.ChecksumIEEE([]byte("value1")), version: newVersion()}
+	if err := cache.replicate("key1", nodes, data, 0, callOptions{async: true}); err != nil {
+		t.Fatalf("async set failed: %v", err)
+	}
+
+	if !waitFor(func() bool { return cache.hints.pending(nodes[0].ID) }) {
+		t.Errorf("async copy to silent owner %s still in flight", nodes[0].ID)
+	}
+
+	// Write only the owner decides on fails instead of waiting for the owner forever
+	start := time.Now()
+	_, err := cache.writeOnOwner("key1", ownerWrite{
+		op: "incr",
+		url: func(cnode *cacheNode, epoch string) string {
+			return createURLForIncr(cnode, "key1", 1, counterOptions{}, epoch)
+		},
+		refused: func(int, cacheData) error { return nil },
+	}, callOptions{})
+
+	if err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("increment on silent owner returned %v after %v", err, time.Since(start))
+	}
+}
+
+func TestHeartbeatRefreshesLoad(t *testing.T) {
+	cache := newDistributedCache(0, config{virtualNodes: 10, loadFactor: 0.25})
+	cache.addNode(nodeInfo{ID: "node1"})
+	cache.addNode(nodeInfo{ID: "node2", Load: 10})
+	cache.addNode(nodeInfo{ID: "node2", Load: 40})
+
+	for _, info := range cache.getPeers() {
+		if info.ID == "node2" && info.Load != 40 {
+			t.Errorf("node2 load is %d, expected 40 from the last heartbeat", info.Load)
+		}
+	}
+}
+
+func TestHeartbeatFits(t *testing.T) {
+	node := nodeInfo{ID: "node1", Load: 100000, Overflow: map[string]int{}}
+	for i := 0; i < 500; i++ {
+		node.Overflow[fmt.Sprintf("full-node-%d", i)] = i + 1
+	}
+
+	data, err := encodeHeartbeat(&node)
+	if err != nil || len(data) > heartbeatBytes {
+		t.Fatalf("heartbeat of %d bytes: %v", len(data), err)
+	}
+
+	if len(node.Overflow) == 0 || len(node.Overflow) == 500 {
+		t.Fatalf("%d overflow counts advertised", len(node.Overflow))
+	}
+
+	// Counts of the most keys are the ones kept
+	for i := 500 - len(node.Overflow); i < 500; i++ {
+		if node.Overflow[fmt.Sprintf("full-node-%d", i)] != i+1 {
+			t.Errorf("overflow of full-node-%d left out", i)
+		}
+	}
+
+	var decoded nodeInfo
+	if err := json.Unmarshal(data, &decoded); err != nil || !maps.Equal(decoded.Overflow, node.Overflow) {
+		t.Errorf("heartbeat does not carry the advertised overflow: %v", err)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10, hintBytes: 1024, hintTTL: time.Minute})
+	cache := cluster.caches[0]
+
+	// Point the coordinator at a closed port for one replica so it looks down
+	replica := cache.getNodes("key1", 2)[2]
+	port := replica.Port
+	replica.Port = "1"
+
+	if err := cache.set("key1", []byte("value1")); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	waitFor(func() bool {
+		return cache.hints.pending(replica.ID)
+	})
+
+	if stats := cache.stats.snapshot(); stats.HintsStored != 1 {
+		t.Fatalf("expected 1 stored hint, got %d", stats.HintsStored)
+	}
+
+	// Heartbeat of the replica shows up again, the missed write is replayed
+	replica.Port = port
+	cache.addNode(replica.nodeInfo)
+
+	waitFor(func() bool {
+		return cache.stats.snapshot().HintsReplayed > 0
+	})
+
+	data, found := cluster.local(cluster.byID(replica.ID)).get("key1")
+	if !found || string(data.bytes) != "value1" || data.copy != 2 {
+		t.Errorf("hint not replayed to %s: %v %v", replica.ID, found, data)
+	}
+
+	// Store is bounded and hints expire
+	store := newHintStore(10, time.Millisecond)
+	if !store.add("node2", "key", cacheData{bytes: []byte("12345"), version: 1}, 1) || store.add("node2", "key", cacheData{bytes: []byte("12345"), version: 2}, 1) {
+		t.Errorf("hint store does not honour its size")
+	}
+
+	if dropped := store.expire(time.Now().Add(time.Second)); dropped != 1 || store.bytes != 0 || store.pending("node2") {
+		t.Errorf("expired hints kept, dropped %d, %d bytes left", dropped, store.bytes)
+	}
+}
+
+func TestHintReplaySilentPeer(t *testing.T) {
+	cluster := newTestCluster(t, 3, 1, config{virtualNodes: 10, hintBytes: 1024, hintTTL: time.Minute, timeout: 100 * time.Millisecond})
+	cache := cluster.caches[0]
+	replica := cache.getNodeByID("node2")
+
+	cache.storeHint(replica, 1, "key1", cacheData{bytes: []byte("value1"), version: 1})
+	cache.storeHint(replica, 1, "key2", cacheData{bytes: []byte("value2"), version: 1})
+
+	// Node is back but accepts the replay and never answers
+	replica.Port = silentPeer(t)
+
+	start := time.Now()
+	cache.replayHints(replica.ID)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("replay took %v with a silent peer", elapsed)
+	}
+
+	// Undelivered hints are kept for the next replay
+	if !cache.hints.pending(replica.ID) {
+		t.Errorf("hints of %s lost or still marked as replaying", replica.ID)
+	}
+}
+func TestAntiEntropy(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10, syncRate: 1000})
+
+	// Copies diverged, node2 holds an older key1 and node3 lost it, only node2 has key2
+	cluster.local(0).set("key1", 0, []byte("new"), 2)
+	cluster.local(1).set("key1", 1, []byte("old"), 1)
+	cluster.local(1).set("key2", 1, []byte("only"), 1)
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("same%d", i)
+		for n := 0; n < 3; n++ {
+			cluster.local(n).set(key, n, []byte(key), 1)
+		}
+	}
+
+	if err := cluster.caches[0].antiEntropy(); err != nil {
+		t.Fatalf("anti-entropy failed: %v", err)
+	}
+
+	for n := 0; n < 3; n++ {
+		if data, found := cluster.local(n).get("key1"); !found || string(data.bytes) != "new" || data.version != 2 {
+			t.Errorf("node%d key1: %v %v", n+1, found, data)
+		}
+
+		if data, found := cluster.local(n).get("key2"); !found || string(data.bytes) != "only" {
+			t.Errorf("node%d key2: %v %v", n+1, found, data)
+		}
+	}
+
+	// Only the differing keys are streamed, one push to node2, pull from node2 and two pushes to node3
+	if keys := cluster.caches[0].stats.snapshot().SyncKeys; keys != 4 {
+		t.Errorf("expected 4 keys streamed, got %d", keys)
+	}
+
+	tree := buildMerkleTree(cluster.caches[0].sharedEntries("node3", nil))
+	if buckets := tree.diff(buildMerkleTree(cluster.caches[2].sharedEntries("node1", nil))); len(buckets) != 0 {
+		t.Errorf("trees of node1 and node3 still differ in %v", buckets)
+	}
+}
+
+func TestAntiEntropySilentPeer(t *testing.T) {
+	cluster := newTestCluster(t, 2, 1, config{virtualNodes: 10, timeout: 100 * time.Millisecond})
+	cache := cluster.caches[0]
+
+	// Peer accepts the tree request and never answers
+	cache.getNodeByID("node2").Port = silentPeer(t)
+
+	for round := 0; round < 2; round++ {
+		start := time.Now()
+		err := cache.antiEntropy()
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("round %d took %v with a silent peer", round, elapsed)
+		}
+
+		// Next round runs again instead of finding the previous one still in progress
+		if err == nil || strings.Contains(err.Error(), "already running") {
+			t.Errorf("round %d: %v", round, err)
+		}
+	}
+}
+
+func TestStopEndsAntiEntropy(t *testing.T) {
+	store := &lockedStore{entries: map[string]Entry{}}
+	cluster := newTestCluster(t, 2, 1, config{virtualNodes: 10, syncRate: 20})
+	cache := cluster.caches[0]
+	cluster.local(0).attach(store)
+
+	// node1 misses every key of node2 and pulls them slowly
+	for i := 0; i < 50; i++ {
+		cluster.local(1).set(fmt.Sprintf("key%d", i), 1, []byte("value"), newVersion())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cache.antiEntropy()
+		close(done)
+	}()
+
+	waitFor(func() bool {
+		return cache.stats.snapshot().SyncKeys > 0
+	})
+
+	start := time.Now()
+	cache.stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stop took %v with anti-entropy in progress", elapsed)
+	}
+
+	select {
+	case <-done:
+	default:
+		t.Errorf("anti-entropy still running after stop returned")
+	}
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if store.closed != 1 || store.usedClosed != 0 {
+		t.Errorf("store closed %d times and used %d times after close", store.closed, store.usedClosed)
+	}
+}
+
+func TestRebalanceOnJoin(t *testing.T) {
+	cluster := newTestCluster(t, 4, 1, config{virtualNodes: 10, hasher: XXHash64})
+	joining := cluster.local(3).nodeInfo
+
+	// First three nodes have not seen node4 yet
+	for i := 0; i < 3; i++ {
+		cluster.caches[i].hashRing.removeNode(joining.ID)
+	}
+
+	for i := 0; i < 200; i++ {
+		if err := cluster.caches[0].set(fmt.Sprintf("key%d", i), []byte("value"), WithAcks(2)); err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		from := cluster.caches[i].hashRing.snapshot()
+		cluster.caches[i].hashRing.addNode(joining)
+		cluster.caches[i].rebalance(from, cluster.caches[i].hashRing.snapshot())
+	}
+
+	stats := cluster.caches[0].stats.snapshot()
+	t.Logf("node1 moved %d keys, %d bytes, dropped %d", stats.RebalanceKeys, stats.RebalanceBytes, stats.RebalanceDropped)
+
+	if stats.RebalancePending != 0 || stats.RebalanceRounds != 1 {
+		t.Errorf("rebalance not finished: %d pending after %d rounds", stats.RebalancePending, stats.RebalanceRounds)
+	}
+
+	moved := 0
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners := cluster.caches[0].hashRing.ownerIDs(key, 1)
+
+		for n := 0; n < 4; n++ {
+			data, found := cluster.local(n).get(key)
+			copy := slices.Index(owners, fmt.Sprintf("node%d", n+1))
+
+			if copy < 0 && found {
+				t.Errorf("node%d still holds %s it does not own", n+1, key)
+			}
+
+			if copy >= 0 && (!found || data.copy != copy) {
+				t.Errorf("node%d should hold copy %d of %s: %v %v", n+1, copy, key, found, data)
+			}
+		}
+
+		if slices.Contains(owners, joining.ID) {
+			moved++
+		}
+	}
+
+	if moved == 0 {
+		t.Errorf("node4 does not own any key")
+	}
+}
+
+func TestRebalanceKeepsUnconfirmedCopy(t *testing.T) {
+	cluster := newTestCluster(t, 3, 1, config{virtualNodes: 10})
+
+	// node2 holds the only copy, node1 which stays an owner missed the write
+	// and node3 which joins the owners has not got it yet
+	for _, key := range []string{"moved", "kept"} {
+		cluster.local(1).set(key, 1, []byte("value"), newVersion())
+	}
+
+	cluster.caches[1].rebalanceKey(context.Background(), "moved", []string{"node1", "node2"}, []string{"node3", "node1"})
+
+	if _, found := cluster.local(1).get("moved"); found {
+		t.Errorf("node2 still holds moved after new owners confirmed it")
+	}
+
+	for n, copy := range map[int]int{2: 0, 0: 1} {
+		if data, found := cluster.local(n).get("moved"); !found || data.copy != copy {
+			t.Errorf("node%d should hold copy %d of moved: %v %v", n+1, copy, found, data)
+		}
+	}
+
+	// node3 cannot be reached, node2 keeps its copy rather than losing the key
+	cluster.servers[2].Close()
+	cluster.caches[1].rebalanceKey(context.Background(), "kept", []string{"node1", "node2"}, []string{"node3", "node1"})
+
+	if _, found := cluster.local(1).get("kept"); !found {
+		t.Errorf("node2 dropped kept although node3 never confirmed it")
+	}
+}
+
+func TestStopEndsRebalance(t *testing.T) {
+	store := &lockedStore{entries: map[string]Entry{}}
+	cluster := newTestCluster(t, 1, 0, config{virtualNodes: 10})
+	cache := cluster.caches[0]
+	cluster.local(0).attach(store)
+
+	for i := 0; i < 50; i++ {
+		cluster.local(0).set(fmt.Sprintf("key%d", i), 0, []byte("value"), newVersion())
+	}
+
+	// Joining node accepts the moved keys and never answers
+	from := cache.hashRing.snapshot()
+	cache.hashRing.addNode(nodeInfo{ID: "node2", IP: "127.0.0.1", Port: silentPeer(t)})
+
+	done := make(chan struct{})
+	go func() {
+		cache.rebalance(from, cache.hashRing.snapshot())
+		close(done)
+	}()
+
+	waitFor(func() bool {
+		return cache.stats.snapshot().RebalanceRounds > 0
+	})
+
+	start := time.Now()
+	cache.stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stop took %v with a rebalance in progress", elapsed)
+	}
+
+	select {
+	case <-done:
+	default:
+		t.Errorf("rebalance still running after stop returned")
+	}
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if store.closed != 1 || store.usedClosed != 0 {
+		t.Errorf("store closed %d times and read %d times after close", store.closed, store.usedClosed)
+	}
+}
+
+func TestReReplicationAfterEviction(t *testing.T) {
+	cluster := newTestCluster(t, 4, 1, config{virtualNodes: 10, hasher: XXHash64})
+
+	for i := 0; i < 200; i++ {
+		if err := cluster.caches[0].set(fmt.Sprintf("key%d", i), []byte("value"), WithAcks(2)); err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+
+	// node4 stops sending heartbeats and the others evict it
+	cluster.servers[3].Close()
+	lost := cluster.local(3).count()
+
+	for i := 0; i < 3; i++ {
+		cache := cluster.caches[i]
+		from := cache.hashRing.snapshot()
+
+		cache.mtx.Lock()
+		cache.removeNode_unlocked("node4")
+		cache.mtx.Unlock()
+
+		cache.rebalance(from, cache.hashRing.snapshot())
+	}
+
+	promoted := 0
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners := cluster.caches[0].hashRing.ownerIDs(key, 1)
+
+		copies := 0
+		for n := 0; n < 3; n++ {
+			data, found := cluster.local(n).get(key)
+			copy := slices.Index(owners, fmt.Sprintf("node%d", n+1))
+
+			if copy >= 0 && (!found || data.copy != copy) {
+				t.Errorf("node%d should hold copy %d of %s: %v %v", n+1, copy, key, found, data)
+			}
+
+			if found {
+				copies++
+			}
+		}
+
+		if copies != 2 {
+			t.Errorf("%s has %d copies, expected 2", key, copies)
+		}
+
+		if old := cluster.caches[3].hashRing.ownerIDs(key, 1); old[0] == "node4" {
+			promoted++
+		}
+	}
+
+	t.Logf("node4 held %d keys, %d replicas were promoted to owner", lost, promoted)
+	if promoted == 0 {
+		t.Errorf("no key was owned by node4")
+	}
+}
+
+func TestLeaveHandsOffKeys(t *testing.T) {
+	cluster := newTestCluster(t, 4, 1, config{virtualNodes: 10, hasher: XXHash64})
+
+	for i := 0; i < 200; i++ {
+		if err := cluster.caches[0].set(fmt.Sprintf("key%d", i), []byte("value"), WithAcks(2)); err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+
+	// node4 leaves, the others act on its announcement
+	leaving := cluster.caches[3]
+	if err := leaving.handoff(context.Background()); err != nil {
+		t.Fatalf("handoff failed: %v", err)
+	}
+
+	if leaving.stats.handoffKeys.Load() == 0 || leaving.stats.handoffFailed.Load() != 0 {
+		t.Errorf("unexpected handoff counters %+v", leaving.stats.snapshot())
+	}
+
+	for i := 0; i < 3; i++ {
+		cluster.caches[i].peerLeaving("node4")
+		if cluster.caches[i].getNodeByID("node4") != nil {
+			t.Errorf("node%d still routes to node4", i+1)
+		}
+	}
+
+	// Every key is back to two copies before any survivor rebalanced
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i)
+		for _, id := range cluster.caches[0].hashRing.ownerIDs(key, 1) {
+			if _, found := cluster.local(cluster.byID(id)).get(key); !found {
+				t.Errorf("%s is missing on its owner %s", key, id)
+			}
+		}
+	}
+
+	// Deadline already passed, nothing is handed over
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := leaving.handoff(ctx); !errors.Is(err, ErrHandoffTimeout) {
+		t.Errorf("expected handoff timeout, got %v", err)
+	}
+}
+
+func TestLeaveWithSilentPeer(t *testing.T) {
+	// Peer accepts connections and never answers, it only drops them after a while
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			time.AfterFunc(300*time.Millisecond, func() { conn.Close() })
+		}
+	}()
+
+	store := &lockedStore{entries: map[string]Entry{}}
+	cluster := newTestCluster(t, 1, 0, config{virtualNodes: 10})
+	cache := cluster.caches[0]
+	cluster.local(0).attach(store)
+
+	for i := 0; i < 10; i++ {
+		cluster.local(0).set(fmt.Sprintf("key%d", i), 0, []byte("value"), newVersion())
+	}
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	cache.hashRing.addNode(nodeInfo{ID: "node2", IP: host, Port: port})
+
+	// Leave announcement goes nowhere
+	cache.sendConn, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer cache.sendConn.Close()
+
+	start := time.Now()
+	if err := cache.leave(200 * time.Millisecond); !errors.Is(err, ErrHandoffTimeout) {
+		t.Errorf("expected handoff timeout, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("leave took %v with a silent peer", elapsed)
+	}
+
+	// Handoff is over by the time leave returns, keys are no longer read once the peer gives up
+	time.Sleep(500 * time.Millisecond)
+
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if store.closed != 1 || store.usedClosed != 0 {
+		t.Errorf("store closed %d times and read %d times after close", store.closed, store.usedClosed)
+	}
+}
+
+func TestLeaveWithRefusingPeer(t *testing.T) {
+	cluster := newTestCluster(t, 1, 0, config{virtualNodes: 10})
+	cache := cluster.caches[0]
+
+	for i := 0; i < 10; i++ {
+		cluster.local(0).set(fmt.Sprintf("key%d", i), 0, []byte("value"), newVersion())
+	}
+
+	// Next owner refuses connections, the keys it would take cannot be handed over
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	cache.hashRing.addNode(nodeInfo{ID: "node2", IP: host, Port: port})
+
+	cache.sendConn, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer cache.sendConn.Close()
+
+	err = cache.leave(2 * time.Second)
+	if !errors.Is(err, ErrHandoffFailed) || errors.Is(err, ErrHandoffTimeout) {
+		t.Errorf("expected handoff failure, got %v", err)
+	}
+
+	if stats := cache.stats.snapshot(); stats.HandoffFailed == 0 || stats.HandoffKeys != 0 {
+		t.Errorf("unexpected handoff counters %+v", stats)
+	}
+}
+
+func TestRemoveLeavesTombstones(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10, syncRate: 1000, consistency: ConsistencyAll})
+	cache := cluster.caches[0]
+
+	if err := cache.set("key1", []byte("value1"), WithAcks(3)); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	if err := cache.remove("key1", WithAcks(3)); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	for n := 0; n < 3; n++ {
+		if data, found := cluster.local(n).lookup("key1"); !found || !data.tombstone() {
+			t.Errorf("node%d has no tombstone of key1: %v %v", n+1, found, data)
+		}
+
+		if cluster.local(n).count() != 0 {
+			t.Errorf("node%d counts its tombstone as a key", n+1)
+		}
+	}
+
+	// A write older than the remove arriving late is ignored
+	tombstone, _ := cluster.local(1).lookup("key1")
+	cluster.local(1).set("key1", 1, []byte("late"), tombstone.version-1)
+	if _, found := cluster.local(1).get("key1"); found {
+		t.Errorf("late write brought key1 back")
+	}
+
+	// node3 missed the remove, reads and anti-entropy do not resurrect the key
+	cluster.local(2).remove("key1")
+	cluster.local(2).set("key1", 2, []byte("value1"), tombstone.version-1)
+
+	if _, found := cache.get("key1"); found {
+		t.Errorf("read returned a removed key")
+	}
+
+	if err := cache.antiEntropy(); err != nil {
+		t.Fatalf("anti-entropy failed: %v", err)
+	}
+
+	if data, found := cluster.local(2).lookup("key1"); !found || !data.tombstone() {
+		t.Errorf("anti-entropy did not remove key1 from node3: %v %v", found, data)
+	}
+
+	// Tombstones go once their grace period is over
+	if purged := cluster.local(0).purge(time.Now().Add(time.Second)); purged != 1 {
+		t.Errorf("expected one tombstone purged, got %d", purged)
+	}
+
+	// Remove needs the write quorum like a set
+	cluster.servers[1].Close()
+	cluster.servers[2].Close()
+
+	cache.config.writeQuorum = 2
+	if err := cache.remove("key2"); !errors.Is(err, ErrWriteQuorum) {
+		t.Errorf("expected write quorum error, got %v", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	cluster := newTestCluster(t, 3, 1, config{virtualNodes: 10})
+	cache := cluster.caches[0]
+
+	version, err := cache.setIf("key1", []byte("first"), ifAbsent)
+	if err != nil || version == 0 {
+		t.Fatalf("set if absent failed: %d %v", version, err)
+	}
+
+	if _, err := cache.setIf("key1", []byte("second"), ifAbsent); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected conflict on existing key, got %v", err)
+	}
+
+	if _, err := cache.setIf("key2", []byte("second"), ifPresent); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected conflict on missing key, got %v", err)
+	}
+
+	// Only the writer holding the current version wins
+	if _, err := cache.setIf("key1", []byte("stale"), ifVersion(version-1)); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected conflict on stale version, got %v", err)
+	}
+
+	swapped, err := cache.setIf("key1", []byte("swapped"), ifVersion(version))
+	if err != nil || swapped <= version {
+		t.Fatalf("compare and swap failed: %d %v", swapped, err)
+	}
+
+	if _, err := cache.setIf("key1", []byte("again"), ifVersion(version)); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected conflict once version moved, got %v", err)
+	}
+
+	// Replica holds the swapped value under the version the owner assigned
+	waitFor(func() bool {
+		data, _ := cluster.local(cluster.byID(cache.getNodes("key1", 1)[1].ID)).get("key1")
+		return data.version == swapped
+	})
+	for copy, node := range cache.getNodes("key1", 1) {
+		data, found := cluster.local(cluster.byID(node.ID)).get("key1")
+		if !found || string(data.bytes) != "swapped" || data.version != swapped || data.copy != copy {
+			t.Errorf("%s: unexpected copy of key1 %v %v", node.ID, found, data)
+		}
+	}
+
+	if data, found := cache.read("key1"); !found || data.version != swapped {
+		t.Errorf("read returned version %d, expected %d", data.version, swapped)
+	}
+
+	// Removed key is absent again
+	if err := cache.remove("key1"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	if _, err := cache.setIf("key1", []byte("reborn"), ifVersion(0)); err != nil {
+		t.Errorf("compare and swap on removed key failed: %v", err)
+	}
+
+	// Many writers race for the same version, exactly one wins
+	current, _ := cache.read("key1")
+
+	wins := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			_, err := cluster.caches[i%3].setIf("key1", []byte(fmt.Sprint(i)), ifVersion(current.version))
+			wins <- err
+		}(i)
+	}
+
+	won := 0
+	for i := 0; i < 10; i++ {
+		if err := <-wins; err == nil {
+			won++
+		} else if !errors.Is(err, ErrConflict) {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+
+	if won != 1 {
+		t.Errorf("%d writers won the same version", won)
+	}
+}
+
+func TestOwnerWritesRedirectedFromReplica(t *testing.T) {
+	cluster := newTestCluster(t, 3, 1, config{virtualNodes: 10})
+	nodes := cluster.caches[0].getNodes("key1", 1)
+	replica := cluster.local(cluster.byID(nodes[1].ID))
+	owners := nodes[0].ID + "," + nodes[1].ID
+
+	// Caller routes with another ring and reached a node holding copy 1
+	writes := map[string]string{
+		"conditional write": createURLForSetIf(replica, "key1", ifAbsent, "stale-epoch"),
+		"increment":         createURLForIncr(replica, "key1", 1, counterOptions{}, "stale-epoch"),
+		"touch":             createURLForTouch(replica, "key1", time.Minute, "stale-epoch"),
+	}
+
+	for name, url := range writes {
+		w := httptest.NewRecorder()
+		replica.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, strings.NewReader(`{"key1":"dmFsdWU="}`)))
+
+		if w.Code != http.StatusMisdirectedRequest || w.Header().Get(ownersHeader) != owners {
+			t.Errorf("%s served by replica %s: %d %s", name, replica.ID, w.Code, w.Header().Get(ownersHeader))
+		}
+	}
+
+	if _, found := replica.get("key1"); found {
+		t.Errorf("replica %s stored key1 from a write only the owner decides on", replica.ID)
+	}
+
+	// Copies are still taken by any node owning the key
+	w := httptest.NewRecorder()
+	replica.ServeHTTP(w, httptest.NewRequest(http.MethodPost, createURLForSet(replica, "key1", 1, newVersion(), "stale-epoch"), strings.NewReader(`{"key1":"dmFsdWU="}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("copy of key1 refused by replica %s: %d", replica.ID, w.Code)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	cluster := newTestCluster(t, 3, 1, config{virtualNodes: 10})
+	cache := cluster.caches[0]
+
+	// Increments from every node race on the same counter, none is lost
+	errs := make(chan error, 30)
+	for i := 0; i < 30; i++ {
+		go func(i int) {
+			_, err := cluster.caches[i%3].incr("hits", 1)
+			errs <- err
+		}(i)
+	}
+
+	for i := 0; i < 30; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("incr failed: %v", err)
+		}
+	}
+
+	if value, err := cache.incr("hits", -5); err != nil || value != 25 {
+		t.Errorf("expected 25 after decrement, got %d %v", value, err)
+	}
+
+	waitFor(func() bool {
+		data, _ := cluster.local(cluster.byID(cache.getNodes("hits", 1)[1].ID)).get("hits")
+		return string(data.bytes) == "25"
+	})
+	for _, node := range cache.getNodes("hits", 1) {
+		if data, found := cluster.local(cluster.byID(node.ID)).get("hits"); !found || string(data.bytes) != "25" {
+			t.Errorf("%s holds %v %q", node.ID, found, data.bytes)
+		}
+	}
+
+	// Missing counter starts from the initial value and expires with its copies
+	value, err := cache.incr("quota", 1, WithInitialValue(10), WithCounterTTL(200*time.Millisecond))
+	if err != nil || value != 11 {
+		t.Errorf("expected 11 from initial value, got %d %v", value, err)
+	}
+
+	waitFor(func() bool {
+		_, found := cluster.local(cluster.byID(cache.getNodes("quota", 1)[1].ID)).get("quota")
+		return found
+	})
+	for _, node := range cache.getNodes("quota", 1) {
+		if data, found := cluster.local(cluster.byID(node.ID)).get("quota"); !found || data.expires.IsZero() {
+			t.Errorf("%s holds no expiring copy of quota: %v %v", node.ID, found, data)
+		}
+	}
+
+	expired := waitFor(func() bool {
+		_, found := cache.get("quota")
+		return !found
+	})
+	if !expired {
+		t.Errorf("quota did not expire")
+	}
+
+	if value, err := cache.incr("quota", 1, WithInitialValue(10)); err != nil || value != 11 {
+		t.Errorf("expected expired counter to restart at 11, got %d %v", value, err)
+	}
+
+	// Values which are not counters or would overflow are refused
+	cache.set("name", []byte("vitarit"))
+	if _, err := cache.incr("name", 1); !errors.Is(err, ErrNotCounter) {
+		t.Errorf("expected not a counter error, got %v", err)
+	}
+
+	if _, err := cache.incr("max", math.MaxInt64); err != nil {
+		t.Fatalf("incr failed: %v", err)
+	}
+
+	if _, err := cache.incr("max", 1); !errors.Is(err, ErrNotCounter) {
+		t.Errorf("expected overflow error, got %v", err)
+	}
+}
+
+func TestCallOptions(t *testing.T) {
+	cluster := newTestCluster(t, 3, 2, config{virtualNodes: 10, writeQuorum: 1})
+	cache := cluster.caches[0]
+
+	// Key whose last copy is on node3, the one which stops answering
+	key := "key1"
+	for i := 0; cache.getNodes(key, 2)[2].ID != "node3"; i++ {
+		key = fmt.Sprintf("key%d", i)
+	}
+
+	if err := cache.set(key, []byte("value1"), WithAcks(3)); err != nil {
+		t.Fatalf("set acknowledged by all copies failed: %v", err)
+	}
+
+	// node3 accepts connections but never answers
+	blackhole, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer blackhole.Close()
+
+	go func() {
+		for {
+			conn, err := blackhole.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(blackhole.Addr().String())
+	cache.getNodeByID("node3").Port = port
+
+	start := time.Now()
+	if err := cache.set(key, []byte("value2"), WithAcks(3), WithTimeout(100*time.Millisecond)); !errors.Is(err, ErrWriteQuorum) {
+		t.Errorf("expected write quorum error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("set took %v despite its timeout", elapsed)
+	}
+
+	// Default quorum of the instance is one copy
+	if err := cache.set(key, []byte("value3"), WithTimeout(100*time.Millisecond)); err != nil {
+		t.Errorf("set with default quorum failed: %v", err)
+	}
+
+	start = time.Now()
+	if err := cache.set(key, []byte("value4"), WithAcks(3), WithAsync()); err != nil {
+		t.Errorf("async set failed: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("async set waited %v", elapsed)
+	}
+
+	var value []byte
+	var found bool
+	waitFor(func() bool {
+		value, found = cache.get(key, WithConsistency(ConsistencyQuorum), WithTimeout(200*time.Millisecond))
+		return found && string(value) == "value4"
+	})
+	if !found || string(value) != "value4" {
+		t.Errorf("quorum read returned %v %q", found, value)
+	}
+
+	if _, found := cache.get(key, WithConsistency(ConsistencyAll), WithTimeout(100*time.Millisecond)); found {
+		t.Errorf("read of all copies succeeded with node3 not answering")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	cluster := newTestCluster(t, 3, 1, config{virtualNodes: 10})
+	cache := cluster.caches[0]
+
+	if err := cache.setWithTTL("session", []byte("token"), 300*time.Millisecond); err != nil {
+		t.Fatalf("set with ttl failed: %v", err)
+	}
+
+	if ttl, found := cache.ttl("session"); !found || ttl <= 0 || ttl > 300*time.Millisecond {
+		t.Errorf("unexpected ttl %v %v", ttl, found)
+	}
+
+	// Expiry is extended on every copy
+	if err := cache.touch("session", time.Minute, WithAcks(2)); err != nil {
+		t.Fatalf("touch failed: %v", err)
+	}
+
+	for _, node := range cache.getNodes("session", 1) {
+		data, found := cluster.local(cluster.byID(node.ID)).get("session")
+		if !found || string(data.bytes) != "token" || time.Until(data.expires) < 30*time.Second {
+			t.Errorf("%s holds %v %v", node.ID, found, data)
+		}
+	}
+
+	if err := cache.touch("session", 0); err != nil {
+		t.Fatalf("touch failed: %v", err)
+	}
+
+	if ttl, found := cache.ttl("session"); !found || ttl != 0 {
+		t.Errorf("expected key without expiry, got %v %v", ttl, found)
+	}
+
+	if err := cache.touch("missing", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	// Expired key is not returned and reclaimed by the read
+	if err := cache.setWithTTL("short", []byte("lived"), 50*time.Millisecond); err != nil {
+		t.Fatalf("set with ttl failed: %v", err)
+	}
+
+	expired := waitFor(func() bool {
+		_, found := cache.get("short")
+		return !found
+	})
+	if !expired {
+		t.Errorf("expired key returned")
+	}
+
+	owner := cluster.local(cluster.byID(cache.getNodes("short", 1)[0].ID)).shardOf("short")
+	owner.mtx.RLock()
+	_, kept := owner.get("short")
+	owner.mtx.RUnlock()
+	if kept {
+		t.Errorf("expired key not reclaimed on read")
+	}
+
+	// Sweeper reclaims expired keys in batches and leaves the others
+	local := cluster.local(0)
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+	for i := 0; i < 1000; i++ {
+		local.put(fmt.Sprintf("old%d", i), cacheData{bytes: []byte("x"), version: 1, expires: past})
+	}
+	for i := 0; i < 100; i++ {
+		local.put(fmt.Sprintf("new%d", i), cacheData{bytes: []byte("x"), version: 1, expires: future})
+	}
+
+	// Sampling is random, a round may miss the last expired keys of a shard
+	before := local.count()
+	for i := 0; i < 1000 && before-local.count() < 1000; i++ {
+		cache.sweep(time.Now())
+	}
+
+	left := 0
+	for _, sh := range local.shards {
+		sh.mtx.RLock()
+		left += len(sh.expiries)
+		sh.mtx.RUnlock()
+	}
+
+	if removed := before - local.count(); removed != 1000 || left < 100 {
+		t.Errorf("sweeper reclaimed %d keys, %d keys with expiry left", removed, left)
+	}
+
+	if expired := cache.stats.snapshot().Expired; expired != 1000 {
+		t.Errorf("expected 1000 expired keys counted, got %d", expired)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	// Single shard so one policy orders every key and the order they go in is exact
+	cluster := newTestCluster(t, 1, 1, config{virtualNodes: 10, maxBytes: 100, shards: 1})
+	cache := cluster.caches[0]
+	local := cluster.local(0)
+
+	// Every key takes 10 bytes, 2 for the key and 8 for the value
+	value := []byte("12345678")
+	for i := 0; i < 4; i++ {
+		local.put(fmt.Sprintf("p%d", i), cacheData{bytes: value, copy: 0, version: 1})
+		local.put(fmt.Sprintf("r%d", i), cacheData{bytes: value, copy: 1, version: 1})
+	}
+
+	// Reading a primary makes it the last one evicted
+	if _, found := cache.get("p0"); !found {
+		t.Fatalf("expected p0 to be found")
+	}
+
+	// Budget is reached after two more primaries, replicas are evicted first
+	for i := 4; i < 8; i++ {
+		local.put(fmt.Sprintf("p%d", i), cacheData{bytes: value, copy: 0, version: 1})
+	}
+
+	for key, kept := range map[string]bool{"r0": false, "r1": false, "r2": true, "r3": true} {
+		if _, found := local.get(key); found != kept {
+			t.Errorf("expected %s kept %v", key, kept)
+		}
+	}
+
+	// Once the replicas are gone the least recently used primary goes
+	for _, key := range []string{"p8", "p9", "px"} {
+		local.put(key, cacheData{bytes: value, copy: 0, version: 1})
+	}
+
+	for key, kept := range map[string]bool{"r2": false, "r3": false, "p0": true, "p1": false, "p2": true, "px": true} {
+		if _, found := local.get(key); found != kept {
+			t.Errorf("expected %s kept %v", key, kept)
+		}
+	}
+
+	local.shards[0].mtx.RLock()
+	used := local.shards[0].bytes
+	local.shards[0].mtx.RUnlock()
+	if used > 100 {
+		t.Errorf("node holds %d bytes over its budget", used)
+	}
+
+	if stats := cache.stats.snapshot(); stats.Evictions != 5 || stats.EvictedBytes != 50 {
+		t.Errorf("expected 5 evictions of 50 bytes, got %d of %d", stats.Evictions, stats.EvictedBytes)
+	}
+}
+
+// hitRatioTrace returns keys of a workload mixing a hot set with scans over keys read once
+// Every round reads the hot set twice and then scans keys no other round reads
+func hitRatioTrace(hotKeys int, scanKeys int, rounds int) []string {
+	trace := []string{}
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < 2*hotKeys; i++ {
+			trace = append(trace, fmt.Sprintf("hot%d", i%hotKeys))
+		}
+
+		for i := 0; i < scanKeys; i++ {
+			trace = append(trace, fmt.Sprintf("scan%d", round*scanKeys+i))
+		}
+	}
+
+	return trace
+}
+
+func TestEvictionShards(t *testing.T) {
+	// Budget holds for the node as a whole, whatever shard a key lands in
+	cluster := newTestCluster(t, 1, 0, config{virtualNodes: 10, maxBytes: 1 << 20})
+	cache := cluster.caches[0]
+	local := cluster.local(0)
+
+	value := make([]byte, 64<<10)
+	if err := cache.set("big", value); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if got, found := cache.get("big"); !found || len(got) != len(value) {
+		t.Fatalf("expected a value far below the budget to be kept")
+	}
+
+	// Filling the node twice over evicts from every shard, and only as much as it needs to
+	for i := 0; i < 32; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := cache.set(key, value); err != nil {
+			t.Fatalf("set of %s failed: %v", key, err)
+		}
+		if _, found := cache.get(key); !found {
+			t.Errorf("expected %s to be kept right after it was written", key)
+		}
+	}
+
+	used, kept := 0, 0
+	for _, sh := range local.shards {
+		sh.mtx.RLock()
+		used += sh.bytes
+		kept += sh.keys
+		sh.mtx.RUnlock()
+	}
+
+	if used > 1<<20 || used != int(local.bytes.Load()) {
+		t.Errorf("node holds %d bytes over its budget, %d accounted", used, local.bytes.Load())
+	}
+	if limit := (1 << 20) / len(value); kept != limit-1 && kept != limit {
+		t.Errorf("expected the node to keep %d keys, it keeps %d", limit, kept)
+	}
+
+	// Value larger than the whole budget is refused instead of being evicted by its own write
+	if err := cache.set("huge", make([]byte, 2<<20)); err == nil {
+		t.Errorf("expected a value over the budget to be refused")
+	}
+	if _, found := cache.get("huge"); found {
+		t.Errorf("refused value found")
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	policies := []EvictionPolicy{EvictLRU, EvictLFU, EvictARC, EvictTinyLFU}
+
+	// Every policy keeps the node within its budget, evicts replicas first and forgets nothing it tracks
+	for _, policy := range policies {
+		cnode := newCacheNode(nodeInfo{ID: "node1"})
+		cnode.split(1)
+		cnode.bound(1000, policy)
+		sh := cnode.shards[0]
+
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("key%d", i%300)
+			switch i % 7 {
+			case 0:
+				cnode.delete(key, 0, uint64(i+1))
+			case 1:
+				cnode.setCopy(key, i%2)
+			default:
+				cnode.set(key, i%3, []byte("0123456789"), uint64(i+1))
+			}
+			cnode.used(fmt.Sprintf("key%d", (i*7)%300), true)
+
+			if sh.bytes > 1000 {
+				t.Fatalf("%s: node holds %d bytes over its budget", policy, sh.bytes)
+			}
+		}
+
+		// Whatever the node still holds can be evicted, so tracking matches the data
+		evicted := 0
+		for _, tracked := range []evictionPolicy{sh.replicas, sh.primaries} {
+			for key, found := tracked.evict(); found; key, found = tracked.evict() {
+				if data, held := sh.get(key); !held || data.tombstone() {
+					t.Errorf("%s: tracked key %s the node does not hold", policy, key)
+				}
+				evicted++
+			}
+		}
+
+		if live := cnode.count(); evicted != live {
+			t.Errorf("%s: tracked %d keys while holding %d", policy, evicted, live)
+		}
+	}
+
+	// Same trace replayed with each policy
+	trace := hitRatioTrace(50, 200, 20)
+	ratios := make(map[EvictionPolicy]float64)
+	for _, policy := range policies {
+		ratios[policy] = HitRatio(policy, 10000, 90, trace)
+		t.Logf("%s hit ratio %.3f", policy, ratios[policy])
+	}
+
+	// LRU only hits the second read of a round, the others keep the hot set across the scans
+	for _, policy := range []EvictionPolicy{EvictLFU, EvictARC, EvictTinyLFU} {
+		if ratios[policy] < ratios[EvictLRU]+0.1 {
+			t.Errorf("expected %s to resist scans, got %v", policy, ratios)
+		}
+	}
+}
+
+// benchmarkNodeStore runs parallel gets and sets against a node split into the given number of shards
+// Every writesIn4 operations out of 4 are sets, run with -cpu 1,8,32 to see how throughput scales
+func benchmarkNodeStore(b *testing.B, shards int, writesIn4 int) {
+	cnode := newCacheNode(nodeInfo{ID: "node1"})
+	cnode.split(shards)
+
+	value := []byte("value")
+	keys := make([]string, 1<<14)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		cnode.set(keys[i], 0, value, 1)
+	}
+
+	var workers, version atomic.Uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		// Workers start at different keys so they do not walk the shards in step
+		i := int(workers.Add(1) * 7919)
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%4 < writesIn4 {
+				cnode.set(key, 0, value, version.Add(1))
+			} else {
+				cnode.get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkNodeStore(b *testing.B) {
+	for _, mix := range []struct {
+		name      string
+		writesIn4 int
+	}{{"reads", 0}, {"mixed", 1}, {"writes", 4}} {
+		for _, shards := range []int{1, 8, defaultShards} {
+			b.Run(fmt.Sprintf("%s/shards=%d", mix.name, shards), func(b *testing.B) {
+				benchmarkNodeStore(b, shards, mix.writesIn4)
+			})
+		}
+	}
+}
+
+// lockedStore is a store shared by all shards that can be made to fail
+type lockedStore struct {
+	entries    map[string]Entry
+	fail       bool
+	closed     int
+	usedClosed int // Reads and writes made after the store was closed
+	mtx        sync.Mutex
+}
+
+func (store *lockedStore) Get(key string) (Entry, bool) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if store.closed > 0 {
+		store.usedClosed++
+	}
+
+	entry, found := store.entries[key]
+	return entry, found
+}
+
+func (store *lockedStore) Set(key string, entry Entry) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	if store.closed > 0 {
+		store.usedClosed++
+	}
+
+	if store.fail {
+		return errors.New("disk full")
+	}
+
+	store.entries[key] = entry
+	return nil
+}
+
+func (store *lockedStore) Delete(key string) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	delete(store.entries, key)
+	return nil
+}
+
+func (store *lockedStore) Range(fn func(key string, entry Entry) bool) {
+	store.mtx.Lock()
+	entries := maps.Clone(store.entries)
+	store.mtx.Unlock()
+
+	for key, entry := range entries {
+		if !fn(key, entry) {
+			return
+		}
+	}
+}
+
+func (store *lockedStore) Len() int {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	return len(store.entries)
+}
+
+func (store *lockedStore) Close() error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+
+	store.closed++
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	store := &lockedStore{entries: map[string]Entry{
+		"kept": {Value: []byte("old"), Crc: crc32.ChecksumIEEE([]byte("old")), Version: 5},
+		"gone": {Version: 7, Deleted: time.Now()},
+	}}
+
+	cluster := newTestCluster(t, 1, 1, config{virtualNodes: 10})
+	cache := cluster.caches[0]
+	local := cluster.local(0)
+	local.attach(store)
+
+	// Entries already in the store are served
+	if value, found := cache.get("kept"); !found || string(value) != "old" {
+		t.Errorf("expected stored key, got %v %q", found, value)
+	}
+
+	if _, found := cache.get("gone"); found {
+		t.Errorf("stored tombstone returned a value")
+	}
+
+	if count := local.count(); count != 1 {
+		t.Errorf("expected 1 live key, got %d", count)
+	}
+
+	// Writes reach the store with their metadata
+	if err := cache.set("new", []byte("value")); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	if entry, found := store.Get("new"); !found || string(entry.Value) != "value" || entry.Crc != crc32.ChecksumIEEE([]byte("value")) || entry.Version == 0 {
+		t.Errorf("unexpected entry %v %+v", found, entry)
+	}
+
+	if err := cache.remove("kept"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	if entry, found := store.Get("kept"); !found || entry.Deleted.IsZero() || entry.Version <= 5 {
+		t.Errorf("expected tombstone in store, got %v %+v", found, entry)
+	}
+
+	// A write the store refuses fails
+	store.mtx.Lock()
+	store.fail = true
+	store.mtx.Unlock()
+
+	if err := cache.set("refused", []byte("value")); err == nil {
+		t.Errorf("expected write to fail")
+	}
+
+	if _, found := local.get("refused"); found {
+		t.Errorf("refused write is visible")
+	}
+
+	// Store is closed once even when the node is stopped twice
+	cache.stop()
+	cache.stop()
+	if store.closed != 1 {
+		t.Errorf("expected store closed once, got %d", store.closed)
+	}
+}